@@ -17,6 +17,7 @@ package main
 import (
 	"errors"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -26,18 +27,52 @@ import (
 type annotation struct {
 	format        interface{} // "json" or *regexp.Regexp
 	tsKey         string
-	tsLayout      string
+	tsLayouts     []string
+	tsLoc         *time.Location
 	isRFC3339Nano bool
 	msgKey        string
 	multi         *regexp.Regexp
+	types         map[string]string
+	subparsers    []subparser
+	levelKey      string
+	filter        *filter
+	transforms    []transform
+	rules         []rule
+	rateLimit     rateLimit
+	dedup         dedupConf
+	err           error // error in annotation
+	stack         bool
+	conflict      string // how json field type conflicts are resolved
+	maxDepth      int
+	nestKey       string
 	de            *json.ByteDecoder
 	deBuf         []byte
 }
 
+// options
+var (
+	typeConflict = "suffix"
+	maxDepth     = 1
+	nestKey      = "app"
+)
+
+func newAnnotation() *annotation {
+	return &annotation{
+		dedup:    defaultDedup,
+		conflict: typeConflict,
+		maxDepth: maxDepth,
+		nestKey:  nestKey,
+		de:       json.NewByteDecoder(nil),
+		deBuf:    make([]byte, 1024),
+	}
+}
+
 func (a8n *annotation) parse(raw rawLog) (map[string]interface{}, error) {
 	msg, ts := raw.Log, raw.Time
 	var rec map[string]interface{}
-	var err error
+	var err error // reason for parse failure
+	format := "json"
+	tsFound := false
 	switch {
 	case a8n.format == nil:
 		if len(msg) >= 2 && msg[0] == '{' && msg[len(msg)-1] == '}' {
@@ -49,34 +84,15 @@ func (a8n *annotation) parse(raw rawLog) (map[string]interface{}, error) {
 				if k == "msg" || k == "message" {
 					msg = sprint(v)
 					delete(rec, k)
-				} else {
-					if k == "time" || k == "timestamp" || k == "ts" {
-						sv := sprint(v)
-						if _, err := time.Parse(time.RFC3339Nano, sv); err == nil {
-							ts = sv
-							delete(rec, k)
-							continue
-						}
-					}
-					var suffix string
-					switch v.(type) {
-					case string:
-						rec[k] = v
-					case float64:
-						suffix = "$num"
-					case bool:
-						suffix = "$bool"
-					case map[string]interface{}:
-						suffix = "$obj"
-					case []interface{}:
-						suffix = "$arr"
-					}
-					if suffix != "" && !strings.HasSuffix(k, suffix) {
+				} else if k == "time" || k == "timestamp" || k == "ts" {
+					sv := sprint(v)
+					if _, err := time.Parse(time.RFC3339Nano, sv); err == nil {
+						ts = sv
 						delete(rec, k)
-						rec[k+suffix] = v
 					}
 				}
 			}
+			rec = a8n.resolveTypes(rec)
 		}
 	case a8n.format == "json":
 		rec, err = a8n.jsonUnmarshal(msg)
@@ -87,43 +103,21 @@ func (a8n *annotation) parse(raw rawLog) (map[string]interface{}, error) {
 			if k == a8n.msgKey {
 				msg = sprint(v)
 				delete(rec, k)
-			} else {
-				if k == a8n.tsKey {
-					sv := sprint(v)
-					if t, err := time.Parse(a8n.tsLayout, sv); err == nil {
-						if a8n.isRFC3339Nano {
-							ts = sv
-						} else {
-							ts = t.Format(time.RFC3339Nano)
-						}
-						delete(rec, k)
-						continue
-					}
-				}
-				var suffix string
-				switch v.(type) {
-				case string:
-					rec[k] = v
-				case float64:
-					suffix = "$num"
-				case bool:
-					suffix = "$bool"
-				case map[string]interface{}:
-					suffix = "$obj"
-				case []interface{}:
-					suffix = "$arr"
-				}
-				if suffix != "" && !strings.HasSuffix(k, suffix) {
+			} else if k == a8n.tsKey {
+				if t, ok := a8n.parseTime(v); ok {
+					ts, tsFound = t, true
 					delete(rec, k)
-					rec[k+suffix] = v
 				}
 			}
 		}
+		rec = a8n.resolveTypes(rec)
 	default:
 		rec = make(map[string]interface{})
+		var convErrs []interface{}
 		re := a8n.format.(*regexp.Regexp)
 		g := re.FindStringSubmatch(msg)
 		if len(g) == 0 {
+			err, format = errNoMatch, "regex"
 			break
 		}
 		for i, name := range re.SubexpNames() {
@@ -133,30 +127,267 @@ func (a8n *annotation) parse(raw rawLog) (map[string]interface{}, error) {
 			case a8n.msgKey:
 				msg = g[i]
 			case a8n.tsKey:
-				if t, err := time.Parse(a8n.tsLayout, g[i]); err == nil {
-					if a8n.isRFC3339Nano {
-						ts = g[i]
-					} else {
-						ts = t.Format(time.RFC3339Nano)
-					}
+				if t, ok := a8n.parseTime(g[i]); ok {
+					ts, tsFound = t, true
 				} else {
 					rec[name] = g[i]
 				}
 			default:
-				rec[name] = g[i]
+				typ, ok := a8n.types[name]
+				if !ok || g[i] == "" {
+					rec[name] = g[i]
+					continue
+				}
+				if v, err := convertType(typ, g[i]); err == nil {
+					rec[name] = v
+				} else {
+					rec[name] = g[i]
+					convErrs = append(convErrs, name)
+				}
 			}
 		}
+		if len(convErrs) > 0 {
+			rec["@conversion_errors"] = convErrs
+		}
 	}
 
 	if rec == nil {
 		rec = make(map[string]interface{})
 	}
+	if err == nil {
+		format, err = a8n.subparse(rec)
+	}
+	if a8n.err != nil {
+		err, format = a8n.err, "annotation"
+	}
+	if err != nil {
+		rec["@parse_error"] = map[string]interface{}{
+			"format": format,
+			"reason": err.Error(),
+		}
+	}
 	rec["@message"] = msg
 	rec["@timestamp"] = ts
+	a8n.normalizeLevel(rec)
+	if a8n.tsKey != "" && !tsFound {
+		rec["@timestamp_fallback"] = true
+	}
 	return rec, nil
 }
 
-var errNotMap = errors.New("not map")
+// resolveTypes avoids mapping conflicts in elasticsearch,
+// when same json field has values of different types
+func (a8n *annotation) resolveTypes(rec map[string]interface{}) map[string]interface{} {
+	switch a8n.conflict {
+	case "flatten":
+		m := make(map[string]interface{}, len(rec))
+		flatten(m, "", rec, a8n.maxDepth)
+		return m
+	case "stringify":
+		for k, v := range rec {
+			rec[k] = stringify(v, a8n.maxDepth)
+		}
+	case "nest":
+		if len(rec) > 0 {
+			return map[string]interface{}{a8n.nestKey: rec}
+		}
+	default:
+		for k, v := range rec {
+			var suffix string
+			switch v.(type) {
+			case float64:
+				suffix = "$num"
+			case bool:
+				suffix = "$bool"
+			case map[string]interface{}:
+				suffix = "$obj"
+			case []interface{}:
+				suffix = "$arr"
+			}
+			if suffix != "" && !strings.HasSuffix(k, suffix) {
+				delete(rec, k)
+				rec[k+suffix] = v
+			}
+		}
+	}
+	return rec
+}
+
+// flatten copies fields of obj into m with dotted keys.
+// objects nested deeper than depth are stringified
+func flatten(m map[string]interface{}, prefix string, obj map[string]interface{}, depth int) {
+	for k, v := range obj {
+		if o, ok := v.(map[string]interface{}); ok && depth > 0 {
+			flatten(m, prefix+k+".", o, depth-1)
+		} else {
+			m[prefix+k] = stringify(v, 0)
+		}
+	}
+}
+
+// stringify replaces objects and arrays nested
+// deeper than depth with their json string
+func stringify(v interface{}, depth int) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if depth == 0 {
+			return marshal(v)
+		}
+		for k, e := range v {
+			v[k] = stringify(e, depth-1)
+		}
+	case []interface{}:
+		if depth == 0 {
+			return marshal(v)
+		}
+		for i, e := range v {
+			v[i] = stringify(e, depth-1)
+		}
+	}
+	return v
+}
+
+func marshal(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func parseTypeConflict(m map[string]string, prefix string, conflict *string, depth *int, key *string) error {
+	if s, ok := m[prefix+"type_conflict"]; ok {
+		switch s {
+		case "suffix", "flatten", "stringify", "nest":
+			*conflict = s
+		default:
+			return errors.New("invalid " + prefix + "type_conflict " + s)
+		}
+	}
+	if s, ok := m[prefix+"max_depth"]; ok {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return errors.New("invalid " + prefix + "max_depth " + s)
+		}
+		*depth = i
+	}
+	if s, ok := m[prefix+"nest_key"]; ok {
+		if s == "" || strings.HasPrefix(s, "@") {
+			return errors.New("invalid " + prefix + "nest_key " + s)
+		}
+		*key = s
+	}
+	return nil
+}
+
+// convertType converts regex capture s to given type.
+// duration values are converted to milliseconds
+func convertType(typ, s string) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	case "duration":
+		d, err := time.ParseDuration(s)
+		return float64(d) / float64(time.Millisecond), err
+	}
+	panic("unknown type " + typ)
+}
+
+var epochUnits = map[string]time.Duration{
+	"epoch_s":  time.Second,
+	"epoch_ms": time.Millisecond,
+	"epoch_us": time.Microsecond,
+	"epoch_ns": time.Nanosecond,
+}
+
+// parseTime tries each timestamp_layout in order, and
+// returns the timestamp in RFC3339Nano format
+func (a8n *annotation) parseTime(v interface{}) (string, bool) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", false
+	}
+	if a8n.isRFC3339Nano {
+		_, err := time.Parse(time.RFC3339Nano, s)
+		return s, err == nil
+	}
+	for _, layout := range a8n.tsLayouts {
+		var t time.Time
+		var err error
+		if unit, ok := epochUnits[layout]; ok {
+			t, err = parseEpoch(s, unit)
+		} else {
+			t, err = time.ParseInLocation(layout, s, a8n.tsLoc)
+		}
+		if err == nil {
+			return t.Format(time.RFC3339Nano), true
+		}
+	}
+	return "", false
+}
+
+// parseEpoch parses number of units elapsed since
+// January 1, 1970 UTC. s can have fractional part
+func parseEpoch(s string, unit time.Duration) (time.Time, error) {
+	ipart, fpart := s, ""
+	dot := strings.IndexByte(s, '.')
+	if dot != -1 {
+		ipart, fpart = s[:dot], s[dot+1:]
+	}
+	n, err := strconv.ParseInt(ipart, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var frac int64 // nanoseconds
+	if dot != -1 {
+		// validate all digits, as fraction beyond nanoseconds is ignored
+		if fpart == "" {
+			return time.Time{}, errors.New("invalid epoch " + s)
+		}
+		for i := 0; i < len(fpart); i++ {
+			if fpart[i] < '0' || fpart[i] > '9' {
+				return time.Time{}, errors.New("invalid epoch " + s)
+			}
+		}
+		digits := 0 // digits of nanoseconds in unit
+		for u := unit; u > 1; u /= 10 {
+			digits++
+		}
+		if len(fpart) > digits {
+			fpart = fpart[:digits]
+		}
+		for len(fpart) < digits {
+			fpart += "0"
+		}
+		for i := 0; i < len(fpart); i++ {
+			frac = frac*10 + int64(fpart[i]-'0')
+		}
+		if strings.HasPrefix(ipart, "-") {
+			frac = -frac
+		}
+	}
+	// split into seconds and nanoseconds, so that n*unit does not overflow
+	perSec := int64(time.Second / unit)
+	t := time.Unix(n/perSec, n%perSec*int64(unit)+frac).UTC()
+	if y := t.Year(); y < 0 || y > 9999 {
+		return time.Time{}, errors.New("epoch out of range " + s)
+	}
+	return t, nil
+}
+
+var (
+	errNotMap  = errors.New("not map")
+	errNoMatch = errors.New("regex not matched")
+)
 
 func (a8n *annotation) jsonUnmarshal(msg string) (map[string]interface{}, error) {
 	a8n.deBuf = append(a8n.deBuf[:0], msg...)
@@ -176,17 +407,60 @@ func (a8n *annotation) unmarshal(format string) error {
 	if err != nil {
 		return err
 	}
+	if err := parseTypeConflict(m, "", &a8n.conflict, &a8n.maxDepth, &a8n.nestKey); err != nil {
+		return err
+	}
+	if a8n.subparsers, err = parseSubparsers(m); err != nil {
+		return err
+	}
+	a8n.levelKey = m["level_key"]
+	if a8n.filter, err = parseFilter(m, ""); err != nil {
+		return err
+	}
+	if a8n.transforms, err = parseTransforms(m["transform"]); err != nil {
+		return err
+	}
+	if a8n.rules, err = parseRules(m, "rule."); err != nil {
+		return err
+	}
+	if err := parseRateLimit(m, "ratelimit.", &a8n.rateLimit); err != nil {
+		return err
+	}
+	if err := parseDedup(m, "dedup.", &a8n.dedup); err != nil {
+		return err
+	}
+	if s, ok := m["stacktrace"]; ok {
+		if a8n.stack, err = strconv.ParseBool(s); err != nil {
+			return err
+		}
+	}
 	format, ok := m["format"]
 	if !ok {
 		return nil
 	}
 	a8n.tsKey = m["timestamp_key"]
+	if _, ok := m["timestamp_timezone"]; ok && a8n.tsKey == "" {
+		return errors.New("timestamp_timezone requires timestamp_key")
+	}
 	if a8n.tsKey != "" {
-		a8n.tsLayout = m["timestamp_layout"]
-		if a8n.tsLayout == "" {
+		s := m["timestamp_layout"]
+		if s == "" {
 			return errors.New("timestamp_layout missing")
 		}
-		a8n.isRFC3339Nano = a8n.tsLayout == time.RFC3339Nano
+		a8n.tsLayouts = nil
+		for _, layout := range strings.Split(s, "|") {
+			if layout = strings.TrimSpace(layout); layout == "" {
+				return errors.New("empty layout in timestamp_layout " + s)
+			}
+			a8n.tsLayouts = append(a8n.tsLayouts, layout)
+		}
+		a8n.isRFC3339Nano = len(a8n.tsLayouts) == 1 && a8n.tsLayouts[0] == time.RFC3339Nano
+		a8n.tsLoc = time.UTC
+		if s, ok := m["timestamp_timezone"]; ok {
+			if a8n.tsLoc, err = time.LoadLocation(s); err != nil {
+				return err
+			}
+		}
 	}
 
 	a8n.msgKey = m["message_key"]
@@ -203,29 +477,32 @@ func (a8n *annotation) unmarshal(format string) error {
 		}
 		a8n.format = re
 
-		if a8n.tsKey != "" {
-			found := false
-			for _, n := range re.SubexpNames() {
-				if n == a8n.tsKey {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return errors.New("timestamp_key missing in regex")
-			}
+		if a8n.tsKey != "" && !hasGroup(re, a8n.tsKey) {
+			return errors.New("timestamp_key missing in regex")
+		}
+		if !hasGroup(re, a8n.msgKey) {
+			return errors.New("message_key missing in regex")
 		}
 
-		found := false
-		for _, n := range re.SubexpNames() {
-			if n == a8n.msgKey {
-				found = true
-				break
+		if s, ok := m["types"]; ok {
+			a8n.types = make(map[string]string)
+			for _, t := range strings.Split(s, ",") {
+				colon := strings.IndexByte(t, ':')
+				if colon == -1 {
+					return errors.New("types must be in form name:type")
+				}
+				name, typ := strings.TrimSpace(t[:colon]), strings.TrimSpace(t[colon+1:])
+				switch typ {
+				case "int", "float", "bool", "duration":
+				default:
+					return errors.New("invalid type " + typ + " for " + name)
+				}
+				if !hasGroup(re, name) {
+					return errors.New("types: " + name + " missing in regex")
+				}
+				a8n.types[name] = typ
 			}
 		}
-		if !found {
-			return errors.New("message_key missing in regex")
-		}
 
 		if s, ok := m["multiline_start"]; ok {
 			re, err := compileRegex(s)
@@ -239,6 +516,15 @@ func (a8n *annotation) unmarshal(format string) error {
 	return nil
 }
 
+func hasGroup(re *regexp.Regexp, name string) bool {
+	for _, n := range re.SubexpNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 func compileRegex(s string) (*regexp.Regexp, error) {
 	s = strings.TrimSpace(s)
 	if len(s) < 2 || s[0] != '/' || s[len(s)-1] != '/' {
@@ -0,0 +1,379 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestAnnotation(t *testing.T, s string) *annotation {
+	t.Helper()
+	a8n := newAnnotation()
+	if err := a8n.unmarshal(s); err != nil {
+		t.Fatal(err)
+	}
+	return a8n
+}
+
+func TestParseTime(t *testing.T) {
+	a8n := newTestAnnotation(t, `
+		format=json
+		message_key=msg
+		timestamp_key=ts
+		timestamp_layout=2006-01-02 15:04:05 | epoch_s
+		timestamp_timezone=Asia/Kolkata
+	`)
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"layout", "2020-01-02 10:00:00", "2020-01-02T10:00:00+05:30"},
+		{"epochSeconds", "1600000000.123", "2020-09-13T12:26:40.123Z"},
+		{"epochNumber", float64(1600000000), "2020-09-13T12:26:40Z"},
+		{"invalid", "yesterday", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := a8n.parseTime(tt.v)
+			if ok != (tt.want != "") {
+				t.Fatal("ok: got", ok)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEpoch(t *testing.T) {
+	tests := []struct {
+		s    string
+		unit string
+		want string
+	}{
+		{"1600000000", "epoch_s", "2020-09-13T12:26:40Z"},
+		{"1600000000.5", "epoch_s", "2020-09-13T12:26:40.5Z"},
+		{"1600000000123", "epoch_ms", "2020-09-13T12:26:40.123Z"},
+		{"1600000000123.456", "epoch_ms", "2020-09-13T12:26:40.123456Z"},
+		{"1600000000123456", "epoch_us", "2020-09-13T12:26:40.123456Z"},
+		{"1600000000123456789", "epoch_ns", "2020-09-13T12:26:40.123456789Z"},
+		{"-1.5", "epoch_s", "1969-12-31T23:59:58.5Z"},
+		{"-0.5", "epoch_s", "1969-12-31T23:59:59.5Z"},
+		{"-1500.25", "epoch_ms", "1969-12-31T23:59:58.49975Z"},
+		{"10000000000000", "epoch_s", ""},
+	}
+	for _, tt := range tests {
+		got, err := parseEpoch(tt.s, epochUnits[tt.unit])
+		if tt.want == "" {
+			if err == nil {
+				t.Fatal(tt.s, "error expected")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(tt.s, err)
+		}
+		if s := got.Format(time.RFC3339Nano); s != tt.want {
+			t.Fatalf("%s %s: got %q want %q", tt.s, tt.unit, s, tt.want)
+		}
+	}
+	for _, unit := range []string{"epoch_s", "epoch_ms", "epoch_us", "epoch_ns"} {
+		for _, s := range []string{"12ab", "12.", "12.+5", "12.-5", "12.x", "12.1234567891x"} {
+			if _, err := parseEpoch(s, epochUnits[unit]); err == nil {
+				t.Fatal(s, unit, "error expected")
+			}
+		}
+	}
+}
+
+func TestTimezoneWithoutTimestampKey(t *testing.T) {
+	a8n := newAnnotation()
+	err := a8n.unmarshal("format=json\nmessage_key=msg\ntimestamp_timezone=Asia/Kolkata")
+	if err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestEmptyTimestampLayout(t *testing.T) {
+	for _, layout := range []string{"|", "epoch_s|", "epoch_s | | epoch_ms"} {
+		a8n := newAnnotation()
+		err := a8n.unmarshal("format=json\nmessage_key=msg\ntimestamp_key=ts\ntimestamp_layout=" + layout)
+		if err == nil {
+			t.Fatalf("%q: error expected", layout)
+		}
+	}
+}
+
+func TestTimestampFallback(t *testing.T) {
+	a8n := newTestAnnotation(t, `
+		format=json
+		message_key=msg
+		timestamp_key=ts
+		timestamp_layout=epoch_s
+	`)
+	raw := rawLog{Time: "2020-01-02T10:00:00Z", Log: `{"msg":"hello","ts":"yesterday"}`}
+	rec, err := a8n.parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["@timestamp"] != raw.Time {
+		t.Fatal("@timestamp: got", rec["@timestamp"])
+	}
+	if rec["@timestamp_fallback"] != true {
+		t.Fatal("@timestamp_fallback missing")
+	}
+
+	raw.Log = `{"msg":"hello","ts":1600000000}`
+	if rec, err = a8n.parse(raw); err != nil {
+		t.Fatal(err)
+	}
+	if rec["@timestamp"] != "2020-09-13T12:26:40Z" {
+		t.Fatal("@timestamp: got", rec["@timestamp"])
+	}
+	if _, ok := rec["@timestamp_fallback"]; ok {
+		t.Fatal("@timestamp_fallback must not be set")
+	}
+}
+
+func TestTypes(t *testing.T) {
+	a8n := newTestAnnotation(t, `
+		format=/^(?P<status>\S*) (?P<latency>\S*) (?P<ok>\S*) (?P<dur>\S*) (?P<msg>.*)$/
+		message_key=msg
+		types=status:int, latency:float, ok:bool, dur:duration
+	`)
+	rec, err := a8n.parse(rawLog{Log: "200 1.5 true 1.5s hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["status"] != int64(200) || rec["latency"] != 1.5 || rec["ok"] != true || rec["dur"] != float64(1500) {
+		t.Fatal("got:", rec)
+	}
+	if _, ok := rec["@conversion_errors"]; ok {
+		t.Fatal("@conversion_errors must not be set")
+	}
+
+	rec, err = a8n.parse(rawLog{Log: "2xx 1.5 true 1.5s hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["status"] != "2xx" {
+		t.Fatal("status: got", rec["status"])
+	}
+	if errs, ok := rec["@conversion_errors"].([]interface{}); !ok || len(errs) != 1 || errs[0] != "status" {
+		t.Fatal("@conversion_errors: got", rec["@conversion_errors"])
+	}
+}
+
+func TestTypeConflict(t *testing.T) {
+	tests := []struct {
+		conf string
+		want string
+	}{
+		{"", `{"a":"x","b$num":1,"c$obj":{"d":{"e":1}},"f$arr":[1]}`},
+		{"type_conflict=flatten", `{"a":"x","b":1,"c.d":"{\"e\":1}","f":"[1]"}`},
+		{"type_conflict=flatten\nmax_depth=2", `{"a":"x","b":1,"c.d.e":1,"f":"[1]"}`},
+		{"type_conflict=stringify\nmax_depth=0", `{"a":"x","b":1,"c":"{\"d\":{\"e\":1}}","f":"[1]"}`},
+		{"type_conflict=stringify", `{"a":"x","b":1,"c":{"d":"{\"e\":1}"},"f":[1]}`},
+		{"type_conflict=nest\nnest_key=app", `{"app":{"a":"x","b":1,"c":{"d":{"e":1}},"f":[1]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.conf, func(t *testing.T) {
+			a8n := newTestAnnotation(t, tt.conf)
+			rec, err := a8n.parse(rawLog{Log: `{"msg":"hello","a":"x","b":1,"c":{"d":{"e":1}},"f":[1]}`})
+			if err != nil {
+				t.Fatal(err)
+			}
+			delete(rec, "@message")
+			delete(rec, "@timestamp")
+			want, err := jsonUnmarshal([]byte(tt.want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec, want) {
+				t.Fatalf("got %s want %s", marshal(rec), tt.want)
+			}
+		})
+	}
+}
+
+func TestSubparse(t *testing.T) {
+	a8n := newTestAnnotation(t, `
+		format=/^\[(?P<level>\w+)\] (?P<msg>\w+) (?P<payload>{.*?})(?: (?P<kv>.*))?$/
+		message_key=msg
+		subparse.payload=json
+		subparse.kv=logfmt,nest
+	`)
+	rec, err := a8n.parse(rawLog{Log: `[INFO] request {"user":"bob","status":200} took=12ms path="/a b"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(rec, "@timestamp")
+	want := map[string]interface{}{
+		"@message":   "request",
+		"level":      "INFO",
+		"@level":     "info",
+		"@severity":  9,
+		"user":       "bob",
+		"status$num": float64(200),
+		"kv$obj":     map[string]interface{}{"took": "12ms", "path": "/a b"},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %s", marshal(rec))
+	}
+
+	// nested field with type_conflict=nest
+	nested := newTestAnnotation(t, `
+		format=/^(?P<msg>\w+) (?P<kv>.*)$/
+		message_key=msg
+		subparse.kv=logfmt,nest
+		type_conflict=nest
+		nest_key=app
+	`)
+	if rec, err = nested.parse(rawLog{Log: `request took=12ms`}); err != nil {
+		t.Fatal(err)
+	}
+	if got := marshal(rec["app"]); got != `{"kv":{"took":"12ms"}}` {
+		t.Fatal("app: got", got)
+	}
+
+	// invalid payload is left unchanged
+	rec, err = a8n.parse(rawLog{Log: `[INFO] request {bad}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec["payload"] != "{bad}" {
+		t.Fatal("payload: got", rec["payload"])
+	}
+	if perr, ok := rec["@parse_error"].(map[string]interface{}); !ok || perr["format"] != "json" {
+		t.Fatal("@parse_error: got", rec["@parse_error"])
+	}
+
+	// plain text is not logfmt
+	rec, err = a8n.parse(rawLog{Log: `[INFO] request {"user":"bob"} user logged in`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rec["kv$obj"]; ok || rec["kv"] != "user logged in" {
+		t.Fatal("kv: got", rec["kv"], rec["kv$obj"])
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	got, err := parseLogfmt(`a=1 b="x \"y\"" c  d=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": "1", "b": `x "y"`, "c": "", "d": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("got:", got)
+	}
+	for _, s := range []string{"", "=1", `a="x`, "user logged in", "connection reset"} {
+		if _, err := parseLogfmt(s); err == nil {
+			t.Fatalf("%q: error expected", s)
+		}
+	}
+}
+
+func TestNormalizeLevel(t *testing.T) {
+	tests := []struct {
+		conf  string
+		log   string
+		level string
+	}{
+		{"", `{"msg":"hello","level":"WARNING"}`, "warn"},
+		{"", `{"msg":"hello","lvl":"dbg"}`, "debug"},
+		{"", `{"msg":"hello","level":50}`, "error"},
+		{"type_conflict=nest", `{"msg":"hello","severity":"info"}`, "info"},
+		{"", `E0102 15:04:05.123456       1 main.go:12] failed`, "error"},
+		{"", `hello`, ""},
+		{"level_key=prio", `{"msg":"hello","level":"info","prio":"fatal"}`, "fatal"},
+		{"format=/^(?P<lv>\\w+) (?P<msg>.*)$/\nmessage_key=msg\nlevel_key=lv", `ERR failed`, "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.log, func(t *testing.T) {
+			a8n := newTestAnnotation(t, tt.conf)
+			rec, err := a8n.parse(rawLog{Log: tt.log})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.level == "" {
+				if _, ok := rec["@level"]; ok {
+					t.Fatal("@level must not be set")
+				}
+				return
+			}
+			if rec["@level"] != tt.level {
+				t.Fatalf("@level: got %v want %s", rec["@level"], tt.level)
+			}
+			if rec["@severity"] != severities[tt.level] {
+				t.Fatalf("@severity: got %v", rec["@severity"])
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   string
+		log    string
+		format string
+	}{
+		{"regexNoMatch", "format=/^(?P<msg>\\d+)$/\nmessage_key=msg", "hello", "regex"},
+		{"regexMatch", "format=/^(?P<msg>\\d+)$/\nmessage_key=msg", "123", ""},
+		{"json", "format=json\nmessage_key=msg", `{"msg":`, "json"},
+		{"jsonNotObject", "format=json\nmessage_key=msg", `[1]`, "json"},
+		{"detectJSON", "", `{"msg":}`, "json"},
+		{"plain", "", `hello`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a8n := newTestAnnotation(t, tt.conf)
+			rec, err := a8n.parse(rawLog{Log: tt.log})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec["@message"] != tt.log {
+				t.Fatal("@message: got", rec["@message"])
+			}
+			perr, ok := rec["@parse_error"].(map[string]interface{})
+			if tt.format == "" {
+				if ok {
+					t.Fatal("@parse_error must not be set:", perr)
+				}
+				return
+			}
+			if !ok || perr["format"] != tt.format || perr["reason"] == "" {
+				t.Fatal("@parse_error: got", rec["@parse_error"])
+			}
+		})
+	}
+	t.Run("annotation", func(t *testing.T) {
+		a8n := newAnnotation()
+		if a8n.err = a8n.unmarshal("format=json"); a8n.err == nil {
+			t.Fatal("error expected")
+		}
+		rec, err := a8n.parse(rawLog{Log: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perr, ok := rec["@parse_error"].(map[string]interface{}); !ok || perr["format"] != "annotation" {
+			t.Fatal("@parse_error: got", rec["@parse_error"])
+		}
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/santhosh-tekuri/json"
+)
+
+// fileOutput archives records to ndjson files, one file per day
+type fileOutput struct {
+	dir   string
+	files map[string]*bytes.Buffer // contents to be appended, by file name
+	size  int
+}
+
+func parseFileConf(m map[string]string) (output, error) {
+	dir, ok := m["file.dir"]
+	if !ok {
+		return nil, errors.New("config: file.dir missing")
+	}
+	return &fileOutput{dir: dir, files: make(map[string]*bytes.Buffer)}, nil
+}
+
+func (o *fileOutput) add(rec record) (full bool) {
+	s, _ := rec.doc["@timestamp"].(string)
+	ts, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		ts = time.Now()
+	}
+	name := "logflow-" + ts.UTC().Format("2006-01-02") + ".ndjson"
+	buf, ok := o.files[name]
+	if !ok {
+		buf = new(bytes.Buffer)
+		o.files[name] = buf
+	}
+	n := buf.Len()
+	if err := json.NewEncoder(buf).Encode(rec.doc); err != nil {
+		panic(err)
+	}
+	buf.WriteByte('\n')
+	o.size += buf.Len() - n
+	return o.size >= bulkLimit
+}
+
+func (o *fileOutput) flush() (cancelled bool) {
+	round := 0
+	for len(o.files) > 0 {
+		for name, buf := range o.files {
+			if err := appendFile(filepath.Join(o.dir, name), buf.Bytes()); err != nil {
+				if round == 0 {
+					warn(err)
+				}
+				round++
+				select {
+				case <-exitCh:
+					return true
+				case <-time.After(backOff(round, 5*time.Second)):
+				}
+				break
+			}
+			delete(o.files, name)
+		}
+	}
+	if round > 0 {
+		info("archive is writable")
+	}
+	o.size = 0
+	return false
+}
+
+// appendFile appends b to file and syncs it to disk.
+// on failure, file is truncated to its previous size, so
+// that retry does not duplicate partially written lines
+func appendFile(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	size := fi.Size()
+	if _, err = f.Write(b); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if terr := f.Truncate(size); terr != nil {
+			warn("truncate", name, ":", terr)
+		}
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
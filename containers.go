@@ -146,6 +146,12 @@ func runParser(wg *sync.WaitGroup, dir string, records chan<- record) {
 	go func() {
 		defer func() {
 			info("finished", dir[len(qdir):])
+			parseErrorsMu.Lock()
+			if n := parseErrors[dir]; n > 0 {
+				warn(n, "records failed parsing in", dir[len(qdir):])
+			}
+			delete(parseErrors, dir)
+			parseErrorsMu.Unlock()
 			parsersMu.Lock()
 			close(p.closed)
 			delete(parsers, dir)
@@ -0,0 +1,123 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// options
+var defaultDedup dedupConf
+
+type dedupConf struct {
+	window    time.Duration // zero means disabled
+	normalize bool          // ignore numbers when comparing messages
+}
+
+func parseDedup(m map[string]string, prefix string, conf *dedupConf) error {
+	if s, ok := m[prefix+"window"]; ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return errors.New("invalid " + prefix + "window " + s)
+		}
+		conf.window = d
+	}
+	if s, ok := m[prefix+"normalize"]; ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.New("invalid " + prefix + "normalize " + s)
+		}
+		conf.normalize = b
+	}
+	return nil
+}
+
+// dedup collapses consecutive records with identical
+// message within window into a single record.
+//
+// the record is held until a different message arrives or
+// window expires. ext and pos of the last collapsed record
+// are remembered, so that cursor does not move past records
+// which are not yet sent. ext and pos of the first record are
+// kept for document id, so that id does not change on replay
+type dedup struct {
+	conf   dedupConf
+	rec    record
+	key    string
+	count  int
+	first  time.Time
+	lastTS interface{}
+}
+
+func newDedup(conf dedupConf) *dedup {
+	if conf.window == 0 {
+		return nil
+	}
+	return &dedup{conf: conf}
+}
+
+var reNumbers = regexp.MustCompile(`\d+`)
+
+func (d *dedup) keyOf(doc map[string]interface{}) string {
+	msg, _ := doc["@message"].(string)
+	if d.conf.normalize {
+		return reNumbers.ReplaceAllLiteralString(msg, "0")
+	}
+	return msg
+}
+
+// absorb tells whether rec is duplicate of held record
+func (d *dedup) absorb(rec record, now time.Time) bool {
+	if d.rec.doc == nil || now.Sub(d.first) >= d.conf.window || rec.index != d.rec.index || d.keyOf(rec.doc) != d.key {
+		return false
+	}
+	if d.count == 1 {
+		d.rec.firstExt, d.rec.firstPos = d.rec.ext, d.rec.pos
+	}
+	d.count++
+	d.lastTS = rec.doc["@timestamp"]
+	d.rec.ext, d.rec.pos = rec.ext, rec.pos
+	return true
+}
+
+// hold holds rec, so that later duplicates can be collapsed
+func (d *dedup) hold(rec record, now time.Time) {
+	d.rec, d.key = rec, d.keyOf(rec.doc)
+	d.count, d.first, d.lastTS = 1, now, rec.doc["@timestamp"]
+}
+
+// expired tells whether held record should be sent
+func (d *dedup) expired(now time.Time) bool {
+	return d != nil && d.rec.doc != nil && now.Sub(d.first) >= d.conf.window
+}
+
+// take returns held record, with repeat_count, first_timestamp
+// and last_timestamp fields if duplicates are collapsed
+func (d *dedup) take() (rec record, ok bool) {
+	if d == nil || d.rec.doc == nil {
+		return record{}, false
+	}
+	rec = d.rec
+	if d.count > 1 {
+		rec.doc["repeat_count"] = d.count
+		rec.doc["first_timestamp"] = rec.doc["@timestamp"]
+		rec.doc["last_timestamp"] = d.lastTS
+	}
+	d.rec = record{}
+	return rec, true
+}
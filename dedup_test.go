@@ -0,0 +1,82 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	newRec := func(msg, ts string, ext int, pos int64) record {
+		return record{ext: ext, pos: pos, doc: map[string]interface{}{"@message": msg, "@timestamp": ts}}
+	}
+	now := time.Now()
+
+	d := newDedup(dedupConf{window: 10 * time.Second, normalize: true})
+	d.hold(newRec("retry 1 failed", "t1", 0, 10), now)
+	if !d.absorb(newRec("retry 2 failed", "t2", 0, 20), now.Add(time.Second)) {
+		t.Fatal("must absorb")
+	}
+	if !d.absorb(newRec("retry 3 failed", "t3", 1, 5), now.Add(2*time.Second)) {
+		t.Fatal("must absorb")
+	}
+	if d.absorb(newRec("connected", "t4", 1, 15), now.Add(3*time.Second)) {
+		t.Fatal("must not absorb different message")
+	}
+	rec, ok := d.take()
+	if !ok {
+		t.Fatal("must have held record")
+	}
+	if rec.ext != 1 || rec.pos != 5 {
+		t.Fatal("ext/pos: got", rec.ext, rec.pos)
+	}
+	if rec.firstExt != 0 || rec.firstPos != 10 {
+		t.Fatal("firstExt/firstPos: got", rec.firstExt, rec.firstPos)
+	}
+	doc := rec.doc
+	if doc["@message"] != "retry 1 failed" || doc["repeat_count"] != 3 || doc["first_timestamp"] != "t1" || doc["last_timestamp"] != "t3" {
+		t.Fatal("got:", doc)
+	}
+	if _, ok := d.take(); ok {
+		t.Fatal("nothing must be held")
+	}
+
+	// window expiry
+	d.hold(newRec("x", "t1", 0, 10), now)
+	if d.expired(now.Add(9 * time.Second)) {
+		t.Fatal("must not expire")
+	}
+	if d.absorb(newRec("x", "t2", 0, 20), now.Add(10*time.Second)) {
+		t.Fatal("must not absorb after window")
+	}
+	if !d.expired(now.Add(10 * time.Second)) {
+		t.Fatal("must expire")
+	}
+	if rec, _ := d.take(); rec.doc["repeat_count"] != nil {
+		t.Fatal("single record must not have repeat_count")
+	}
+
+	// without normalize
+	d = newDedup(dedupConf{window: 10 * time.Second})
+	d.hold(newRec("retry 1", "t1", 0, 10), now)
+	if d.absorb(newRec("retry 2", "t2", 0, 20), now) {
+		t.Fatal("must not absorb")
+	}
+
+	if newDedup(dedupConf{}) != nil {
+		t.Fatal("must be disabled")
+	}
+}
@@ -16,19 +16,20 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/base64"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	_ "time/tzdata" // docker image has no zoneinfo
 
 	"github.com/santhosh-tekuri/json"
 )
@@ -37,88 +38,204 @@ import (
 var (
 	bulkLimit   = 5 * 1024 * 1024
 	indexPrefix = "logflow-"
-	esURL       = "http://elasticsearch:9200"
-	esAuth      = ""
+	esOpType    = "index"
+	dataStream  template // data stream name, nil if not using data streams
+	esIndex     template // index name
+	esFallback  template // index name, if field used in index name is missing
+	esDocID     = true
 )
 
-func export(r *records) {
-	url := esURL + "/_bulk"
+// date in index name
+var (
+	indexDate        = "2006-01-02" // layout of date suffix added to index prefix
+	indexZone        = time.UTC
+	indexGranularity = "daily"
+)
+
+var indexDateFormats = map[string]string{
+	"hourly":  "yyyy-MM-dd-HH",
+	"daily":   "yyyy-MM-dd",
+	"weekly":  "yyyy-MM-dd",
+	"monthly": "yyyy-MM",
+}
+
+// indexTime converts ts to indexZone, and truncates it
+// to start of hour, day, week or month as per indexGranularity.
+// weeks start on monday
+func indexTime(ts time.Time) time.Time {
+	ts = ts.In(indexZone)
+	y, m, d := ts.Date()
+	switch indexGranularity {
+	case "hourly":
+		return time.Date(y, m, d, ts.Hour(), 0, 0, 0, indexZone)
+	case "weekly":
+		return time.Date(y, m, d-(int(ts.Weekday())+6)%7, 0, 0, 0, 0, indexZone)
+	case "monthly":
+		return time.Date(y, m, 1, 0, 0, 0, 0, indexZone)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, indexZone)
+}
+
+// esOutput sends records to elasticsearch using bulk api
+type esOutput struct {
+	body         *bytes.Buffer
+	enc          *json.Encoder
+	bootstrapped bool
+}
+
+func newESOutput() *esOutput {
 	body := bytes.NewBuffer(make([]byte, 0, bulkLimit))
-	enc := json.NewEncoder(body)
-	for {
-		rec, err := r.next(500 * time.Millisecond)
-		if err == errExit {
-			return
-		}
-		if err == nil {
-			body.WriteString(`{"index":{"_index":"`)
-			body.WriteString(indexPrefix)
-			ts := rec.doc["@timestamp"].(string)
-			body.WriteString(ts[:10]) // year-month-date
-			body.WriteString("\"}}\n")
-			if err := enc.Encode(rec.doc); err != nil {
-				panic(err)
-			}
-			body.WriteByte('\n')
-		}
-		if err == errTimeout || body.Len() >= bulkLimit {
-			if body.Len() > 0 {
-				if cancelled := bulkRetry(url, body.Bytes()); cancelled {
-					return
-				}
-			}
-			r.commit()
-			body.Reset()
+	return &esOutput{
+		body: body,
+		enc:  json.NewEncoder(body),
+	}
+}
+
+func (o *esOutput) add(rec record) (full bool) {
+	body := o.body
+	body.WriteString(`{"`)
+	body.WriteString(esOpType)
+	body.WriteString(`":{"_index":"`)
+	body.WriteString(indexName(rec))
+	if esDocID {
+		body.WriteString(`","_id":"`)
+		body.WriteString(documentID(rec))
+	}
+	body.WriteString("\"}}\n")
+	if err := o.enc.Encode(rec.doc); err != nil {
+		panic(err)
+	}
+	body.WriteByte('\n')
+	return body.Len() >= bulkLimit
+}
+
+// documentID returns id derived from position of rec in container log,
+// so that resending rec after restart or retry does not duplicate it.
+// hash of @timestamp and @message is included, so that records do not
+// overwrite older ones, when positions restart after qdir is lost
+func documentID(rec record) string {
+	cid, _ := rec.k8s["container_id"].(string)
+	if cid == "" {
+		cid = filepath.Base(rec.dir)
+	}
+	ext, pos := rec.ext, rec.pos
+	if rec.firstPos != 0 {
+		// collapsed by dedup, pos is of last duplicate
+		ext, pos = rec.firstExt, rec.firstPos
+	}
+	h := fnv.New64a()
+	ts, _ := rec.doc["@timestamp"].(string)
+	msg, _ := rec.doc["@message"].(string)
+	h.Write([]byte(ts))
+	h.Write([]byte{0})
+	h.Write([]byte(msg))
+	id := cid + "-" + strconv.Itoa(ext) + "-" + strconv.FormatInt(pos, 10) + "-" + strconv.FormatUint(h.Sum64(), 36)
+	if _, ok := rec.doc["@suppressed"]; ok {
+		// rate limit report has position of last record sent
+		id += "-suppressed"
+	}
+	return id
+}
+
+// indexName returns index or data stream to which rec is sent.
+// index routed by rules takes precedence over logflow.io/index
+// annotation, which takes precedence over configured index
+func indexName(rec record) string {
+	ts, err := time.Parse(time.RFC3339Nano, rec.doc["@timestamp"].(string))
+	if err != nil {
+		ts = time.Now()
+	}
+	ts = indexTime(ts)
+	if rec.index != "" {
+		if dataStream != nil {
+			// data stream manages backing indices, no date suffix
+			return sanitizeIndex(rec.index)
 		}
+		return sanitizeIndex(rec.index + ts.Format(indexDate))
+	}
+	t := rec.indexTemplate
+	switch {
+	case t != nil:
+	case dataStream != nil:
+		t = dataStream
+	case rolloverAlias != "":
+		return rolloverAlias
+	default:
+		t = esIndex
+	}
+	name, ok := t.expand(rec.k8s, ts)
+	if !ok && esFallback != nil {
+		name, _ = esFallback.expand(rec.k8s, ts)
 	}
+	return sanitizeIndex(name)
 }
 
-// api call ---
+// sanitizeIndex makes s valid index or data stream name,
+// by lowercasing and replacing disallowed characters with '_'
+func sanitizeIndex(s string) string {
+	b := []byte(replaceIndexChars(s))
+	for len(b) > 0 && (b[0] == '-' || b[0] == '_' || b[0] == '+') {
+		b = b[1:]
+	}
+	if len(b) > 255 {
+		b = b[:255]
+	}
+	if len(b) == 0 || string(b) == "." || string(b) == ".." {
+		return "logflow"
+	}
+	return string(b)
+}
 
-func bulkRetry(url string, body []byte) (cancelled bool) {
-	round := 0
-	for {
-		err := bulk(url, body)
-		if err != nil {
-			if err == context.Canceled {
-				return
-			}
-			if round == 0 {
-				warn(err)
-			}
-			round++
-			select {
-			case <-exitCh:
-				return true
-			case <-time.After(backOff(round, 5*time.Second)):
-				continue
-			}
+// replaceIndexChars lowercases s and replaces characters
+// not allowed in index name with '_'
+func replaceIndexChars(s string) string {
+	b := []byte(strings.ToLower(s))
+	for i, c := range b {
+		switch c {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ',', '#', ':', ' ':
+			b[i] = '_'
 		}
-		if round > 0 {
-			info("elasticsearch is reachable")
+	}
+	return string(b)
+}
+
+func (o *esOutput) flush() (cancelled bool) {
+	if o.body.Len() > 0 {
+		if cancelled := retry("elasticsearch", o.send); cancelled {
+			return true
+		}
+	}
+	o.body.Reset()
+	return false
+}
+
+// send bootstraps elasticsearch if required, and sends body using bulk api
+func (o *esOutput) send() error {
+	if !o.bootstrapped {
+		if err := bootstrapES(); err != nil {
+			return err
 		}
-		return false
+		o.bootstrapped = true
+	}
+	if err := bulk(o.body.Bytes()); err != nil {
+		// elasticsearch might be recreated, when it is reachable again
+		o.bootstrapped = false
+		return err
 	}
+	return nil
 }
 
+// api call ---
+
 var discardBuf = make([]byte, 1024)
 
-func bulk(esurl string, body []byte) error {
+var ndjsonHeader = http.Header{"Content-Type": {"application/x-ndjson"}}
+
+func bulk(body []byte) error {
 	b := body[0:cap(body)]
 	for len(body) > 0 {
-		req, err := http.NewRequestWithContext(exitCtx, http.MethodPost, esurl, bytes.NewReader(body))
+		resp, err := esNodes.do(http.MethodPost, "/_bulk", body, ndjsonHeader)
 		if err != nil {
-			panic(err)
-		}
-		if esAuth != "" {
-			req.Header.Set("Authorization", esAuth)
-		}
-		req.Header.Set("Content-Type", "application/x-ndjson")
-		resp, err := esClient.Do(req)
-		if err != nil {
-			if uerr, ok := err.(*url.Error); ok && uerr.Err == context.Canceled {
-				return uerr.Err
-			}
 			return err
 		}
 		if resp.StatusCode > 299 {
@@ -161,24 +278,25 @@ func bulkErrors(r io.Reader) ([]string, error) {
 			}
 		case prop.Eq("items"):
 			err = json.DecodeArr("items", d, func(d json.Decoder) error {
-				return json.DecodeObj("items[]", d, func(d json.Decoder, prop json.Token) (err error) {
-					return json.DecodeObj("index", d, func(d json.Decoder, prop json.Token) (err error) {
+				return json.DecodeObj("items[]", d, func(d json.Decoder, op json.Token) error {
+					var (
+						msg    string
+						status int
+						shards = -1
+					)
+					err := json.DecodeObj("item", d, func(d json.Decoder, prop json.Token) (err error) {
 						switch {
 						case prop.Eq("error"):
 							var b []byte
 							b, err = d.Marshal()
-							errors = append(errors, string(b))
+							msg = string(b)
+						case prop.Eq("status"):
+							status, err = d.Token().Int("status")
 						case prop.Eq("_shards"):
 							return json.DecodeObj("_shards", d, func(d json.Decoder, prop json.Token) (err error) {
 								switch {
 								case prop.Eq("successful"):
-									var i int
-									i, err = d.Token().Int("successful")
-									if i > 0 {
-										errors = append(errors, "")
-									} else {
-										errors = append(errors, "successful=0")
-									}
+									shards, err = d.Token().Int("successful")
 								default:
 									err = d.Skip()
 								}
@@ -189,6 +307,18 @@ func bulkErrors(r io.Reader) ([]string, error) {
 						}
 						return
 					})
+					switch {
+					case status == http.StatusConflict:
+						// version_conflict: document already exists
+						errors = append(errors, "")
+					case msg != "":
+						errors = append(errors, msg)
+					case shards == 0:
+						errors = append(errors, "successful=0")
+					default:
+						errors = append(errors, "")
+					}
+					return err
 				})
 			})
 		default:
@@ -226,64 +356,141 @@ func checkIndexErrors(body []byte, errors []string) []byte {
 	return body[from:to]
 }
 
-var esClient = &http.Client{
-	Transport: &http.Transport{
-		WriteBufferSize: bulkLimit,
-		DialContext: (&net.Dialer{
-			Timeout:   20 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
+// esTransport is transport of esClient, without authentication
+var esTransport = &http.Transport{
+	WriteBufferSize: bulkLimit,
+	DialContext: (&net.Dialer{
+		Timeout:   20 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
 	},
 }
 
-func parseExportConf(m map[string]string) error {
+var esClient = &http.Client{Transport: esTransport}
+
+func parseESConf(m map[string]string) (output, error) {
 	s, ok := m["elasticsearch.url"]
 	if !ok {
-		return errors.New("config: elasticsearch.url missing")
+		return nil, errors.New("config: elasticsearch.url missing")
+	}
+	urls, err := parseESURLs(s)
+	if err != nil {
+		return nil, fmt.Errorf("config: elasticsearch.url: %v", err)
 	}
-	esURL = s
+	var sniff time.Duration
+	if s, ok = m["elasticsearch.sniff"]; ok {
+		if sniff, err = time.ParseDuration(s); err != nil || sniff < 0 {
+			return nil, errors.New("config: invalid elasticsearch.sniff " + s)
+		}
+	}
+	esNodes = newESPool(urls, sniff)
 	if s, ok = m["elasticsearch.cacert"]; ok {
 		b, err := ioutil.ReadFile(s)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		certPool := x509.NewCertPool()
 		certPool.AppendCertsFromPEM(b)
-		t := esClient.Transport.(*http.Transport).TLSClientConfig
+		t := esTransport.TLSClientConfig
 		t.InsecureSkipVerify = false
 		t.RootCAs = certPool
 	}
 	if s, ok = m["elasticsearch.clientcert"]; ok {
 		key, ok := m["elasticsearch.clientkey"]
 		if !ok {
-			return errors.New("config: elasticsearch.clientkey missing")
+			return nil, errors.New("config: elasticsearch.clientkey missing")
 		}
 		clientCert, err := tls.LoadX509KeyPair(s, key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		t := esClient.Transport.(*http.Transport).TLSClientConfig
+		t := esTransport.TLSClientConfig
 		t.Certificates = []tls.Certificate{clientCert}
 	}
-	if s, ok = m["elasticsearch.basicAuth"]; ok {
-		if strings.IndexByte(s, ':') == -1 {
-			return errors.New("config: elasticsearch.basicAuth has invalid value")
-		}
-		esAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	auth, err := parseESAuth(m)
+	if err != nil {
+		return nil, err
+	}
+	esClient.Transport = esTransport
+	if auth != nil {
+		esClient.Transport = esAuthTransport{esTransport, auth}
 	}
 	if s, ok = m["elasticsearch.bulk_size"]; ok {
 		mb, err := strconv.Atoi(s)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		bulkLimit = mb * 1024 * 1024
-		esClient.Transport.(*http.Transport).WriteBufferSize = bulkLimit
+		esTransport.WriteBufferSize = bulkLimit
 	}
 	if s, ok = m["elasticsearch.index_name.prefix"]; ok {
 		indexPrefix = s
 	}
-	return nil
+	if s, ok = m["elasticsearch.document_id"]; ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("config: invalid elasticsearch.document_id " + s)
+		}
+		esDocID = b
+	}
+	if s, ok = m["elasticsearch.op_type"]; ok {
+		if s != "index" && s != "create" {
+			return nil, errors.New("config: invalid elasticsearch.op_type " + s)
+		}
+		esOpType = s
+	}
+	if s, ok = m["elasticsearch.data_stream"]; ok {
+		t, err := compileTemplate(s)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid elasticsearch.data_stream: %v", err)
+		}
+		if op, ok := m["elasticsearch.op_type"]; ok && op != "create" {
+			return nil, errors.New("config: data streams require elasticsearch.op_type create")
+		}
+		dataStream, esOpType = t, "create"
+	}
+	if s, ok = m["elasticsearch.index.timezone"]; ok {
+		loc, err := time.LoadLocation(s)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid elasticsearch.index.timezone: %v", err)
+		}
+		indexZone = loc
+	}
+	if s, ok = m["elasticsearch.index.granularity"]; ok {
+		if _, ok := indexDateFormats[s]; !ok {
+			return nil, errors.New("config: invalid elasticsearch.index.granularity " + s)
+		}
+		indexGranularity = s
+	}
+	format, ok := m["elasticsearch.index.date_format"]
+	if !ok {
+		format = indexDateFormats[indexGranularity]
+	}
+	if indexDate, ok = dateLayout(format); !ok {
+		return nil, errors.New("config: invalid elasticsearch.index.date_format " + format)
+	}
+	esIndex, esFallback = template{{lit: indexPrefix}, {date: indexDate}}, nil
+	if s, ok = m["elasticsearch.index"]; ok {
+		t, err := compileTemplate(s)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid elasticsearch.index: %v", err)
+		}
+		if dataStream == nil {
+			esFallback = esIndex
+		}
+		esIndex = t
+	}
+	if s, ok = m["elasticsearch.index.fallback"]; ok {
+		t, err := compileTemplate(s)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid elasticsearch.index.fallback: %v", err)
+		}
+		esFallback = t
+	}
+	if err := parseESBootstrapConf(m); err != nil {
+		return nil, err
+	}
+	return newESOutput(), nil
 }
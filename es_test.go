@@ -19,8 +19,25 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
+// newESRecord returns record logged at ts by pod web-1 in namespace prod
+func newESRecord(ts time.Time) record {
+	return record{
+		k8s: map[string]interface{}{
+			"namespace":      "prod",
+			"pod":            "web-1",
+			"container_name": "web",
+			"labels":         map[string]interface{}{"app": "shop"},
+		},
+		doc: map[string]interface{}{
+			"@message":   "hello",
+			"@timestamp": ts.Format(time.RFC3339Nano),
+		},
+	}
+}
+
 func Test_bulkSuccessful(t *testing.T) {
 	s := `
 	{
@@ -146,3 +163,208 @@ func TestCheckIndexErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestBulkErrorsCreate(t *testing.T) {
+	s := `{
+		"errors": true,
+		"items": [
+			{"create": {"_index": ".ds-logs-prod-default-000001", "status": 201, "_shards": {"total": 2, "successful": 1, "failed": 0}}},
+			{"create": {"_index": ".ds-logs-prod-default-000001", "status": 409, "error": {"type": "version_conflict_engine_exception", "reason": "document already exists"}}},
+			{"create": {"_index": "logs-prod-default", "status": 400, "error": {"type": "illegal_argument_exception"}}},
+			{"create": {"_index": ".ds-logs-prod-default-000001", "status": 201, "_shards": {"total": 2, "successful": 0, "failed": 0}}}
+		]
+	}`
+	got, err := bulkErrors(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"", "", `{"type":"illegal_argument_exception"}`, "successful=0"}
+	if !reflect.DeepEqual(got, want) {
+		t.Log(" got:", got)
+		t.Log("want:", want)
+		t.Fail()
+	}
+}
+
+func TestESOutputDataStream(t *testing.T) {
+	restoreESConf(t)
+	o, err := parseESConf(map[string]string{
+		"elasticsearch.url":         "http://elasticsearch:9200",
+		"elasticsearch.data_stream": "logs-{namespace}-{label.team}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newESRecord(time.Now())
+	rec.k8s["labels"] = map[string]interface{}{"team": "Team A"}
+	rec.k8s["container_id"], rec.ext, rec.pos = "abc", 1, 100
+	o.add(rec)
+	rec.index = "audit"
+	o.add(rec)
+	lines := strings.Split(o.(*esOutput).body.String(), "\n")
+	id := documentID(rec)
+	if want := `{"create":{"_index":"logs-prod-team_a","_id":"` + id + `"}}`; lines[0] != want {
+		t.Fatalf("got %s, want %s", lines[0], want)
+	}
+	if want := `{"create":{"_index":"audit","_id":"` + id + `"}}`; lines[2] != want {
+		t.Fatalf("got %s, want %s", lines[2], want)
+	}
+
+	_, err = parseESConf(map[string]string{
+		"elasticsearch.url":         "http://elasticsearch:9200",
+		"elasticsearch.data_stream": "logs-{namespace}-default",
+		"elasticsearch.op_type":     "index",
+	})
+	if err == nil {
+		t.Fatal("data stream with op_type index must fail")
+	}
+}
+
+func TestSanitizeIndex(t *testing.T) {
+	tests := map[string]string{
+		"logs-prod-default": "logs-prod-default",
+		"Logs/Prod:x y":     "logs_prod_x_y",
+		"_-logs":            "logs",
+		"..":                "logflow",
+		"":                  "logflow",
+	}
+	for s, want := range tests {
+		if got := sanitizeIndex(s); got != want {
+			t.Errorf("sanitizeIndex(%q): got %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestIndexName(t *testing.T) {
+	restoreESConf(t)
+	annotation, err := compileTemplate("{namespace}-Audit-{yyyy.MM}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		conf          map[string]string
+		label         interface{}
+		index         string
+		indexTemplate template
+		want          string
+	}{
+		{nil, "shop", "", nil, "logflow-2019-03-04"},
+		{map[string]string{"elasticsearch.index_name.prefix": "logs-"}, "shop", "", nil, "logs-2019-03-04"},
+		{map[string]string{"elasticsearch.index": "{namespace}-{label.app}-{yyyy.MM.dd}"}, "shop", "", nil, "prod-shop-2019.03.04"},
+		{map[string]string{"elasticsearch.index": "{namespace}-{label.app}-{yyyy.MM.dd}"}, nil, "", nil, "logflow-2019-03-04"},
+		{map[string]string{"elasticsearch.index": "{namespace}-{label.app}", "elasticsearch.index.fallback": "{namespace}-other"}, nil, "", nil, "prod-other"},
+		{map[string]string{"elasticsearch.index": "{label.app}-{yyyy.MM.dd}"}, "Shop/Cart", "", nil, "shop_cart-2019.03.04"},
+		{map[string]string{"elasticsearch.index": "{label.app}"}, "shop", "", annotation, "prod-audit-2019.03"},
+		{map[string]string{"elasticsearch.index": "{label.app}"}, "shop", "Audit-", annotation, "audit-2019-03-04"},
+		{map[string]string{"elasticsearch.data_stream": "logs-{label.app}-default"}, nil, "", nil, "logs--default"},
+	}
+	for _, test := range tests {
+		conf := map[string]string{"elasticsearch.url": "http://elasticsearch:9200"}
+		for k, v := range test.conf {
+			conf[k] = v
+		}
+		dataStream, indexPrefix = nil, "logflow-"
+		indexZone, indexGranularity = time.UTC, "daily"
+		if _, err := parseESConf(conf); err != nil {
+			t.Fatal(err)
+		}
+		rec := newESRecord(time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC))
+		rec.k8s["labels"] = map[string]interface{}{}
+		if test.label != nil {
+			rec.k8s["labels"].(map[string]interface{})["app"] = test.label
+		}
+		rec.index, rec.indexTemplate = test.index, test.indexTemplate
+		if got := indexName(rec); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.conf, got, test.want)
+		}
+	}
+}
+
+func TestIndexDate(t *testing.T) {
+	restoreESConf(t)
+	tests := []struct {
+		conf map[string]string
+		ts   string
+		want string
+	}{
+		{nil, "2019-03-04T05:06:07.123Z", "logflow-2019-03-04"},
+		{nil, "2019-03-04T01:00:00+05:30", "logflow-2019-03-03"},
+		{map[string]string{"elasticsearch.index.timezone": "Asia/Kolkata"}, "2019-03-03T20:00:00Z", "logflow-2019-03-04"},
+		{map[string]string{"elasticsearch.index.granularity": "hourly"}, "2019-03-04T05:06:07Z", "logflow-2019-03-04-05"},
+		{map[string]string{"elasticsearch.index.granularity": "weekly"}, "2019-03-10T23:06:07Z", "logflow-2019-03-04"},
+		{map[string]string{"elasticsearch.index.granularity": "weekly"}, "2019-03-11T00:00:00Z", "logflow-2019-03-11"},
+		{map[string]string{"elasticsearch.index.granularity": "monthly"}, "2019-03-31T23:06:07Z", "logflow-2019-03"},
+		{map[string]string{"elasticsearch.index.date_format": "yyyy.MM.dd"}, "2019-03-04T05:06:07Z", "logflow-2019.03.04"},
+		{map[string]string{"elasticsearch.index.granularity": "weekly", "elasticsearch.index": "{namespace}-{yyyy.MM.dd}"}, "2019-03-06T05:06:07Z", "prod-2019.03.04"},
+	}
+	for _, test := range tests {
+		conf := map[string]string{"elasticsearch.url": "http://elasticsearch:9200"}
+		for k, v := range test.conf {
+			conf[k] = v
+		}
+		indexZone, indexGranularity = time.UTC, "daily"
+		if _, err := parseESConf(conf); err != nil {
+			t.Fatal(err)
+		}
+		rec := newESRecord(time.Now())
+		rec.doc["@timestamp"] = test.ts
+		if got := indexName(rec); got != test.want {
+			t.Errorf("%v %s: got %q, want %q", test.conf, test.ts, got, test.want)
+		}
+	}
+
+	for _, conf := range []map[string]string{
+		{"elasticsearch.index.timezone": "Mars/Olympus"},
+		{"elasticsearch.index.granularity": "yearly"},
+		{"elasticsearch.index.date_format": "%Y-%m-%d"},
+		{"elasticsearch.document_id": "ture"},
+	} {
+		conf["elasticsearch.url"] = "http://elasticsearch:9200"
+		if _, err := parseESConf(conf); err == nil {
+			t.Errorf("%v: error expected", conf)
+		}
+	}
+}
+
+func TestDocumentID(t *testing.T) {
+	restoreESConf(t)
+	rec := newESRecord(time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC))
+	rec.dir, rec.ext, rec.pos = "/var/log/containers/logflow/web-1_prod_web-0123", 2, 4096
+	id := documentID(rec)
+	const prefix = "web-1_prod_web-0123-2-4096-"
+	if !strings.HasPrefix(id, prefix) || len(id) == len(prefix) {
+		t.Fatalf("got %q, want prefix %q", id, prefix)
+	}
+	hash := id[len(prefix):]
+	if got := documentID(rec); got != id {
+		t.Fatalf("id must be deterministic, got %q and %q", id, got)
+	}
+	rec.k8s["container_id"] = "0123"
+	if got, want := documentID(rec), "0123-2-4096-"+hash; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	rec.doc["@suppressed"] = 10
+	if got, want := documentID(rec), "0123-2-4096-"+hash+"-suppressed"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	delete(rec.doc, "@suppressed")
+	rec.firstExt, rec.firstPos = 1, 512
+	if got, want := documentID(rec), "0123-1-512-"+hash; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// same position after qdir reset, but different record
+	rec.doc["@timestamp"] = "2020-01-03T10:00:00Z"
+	if got := documentID(rec); got == "0123-1-512-"+hash {
+		t.Fatal("id must depend on @timestamp")
+	}
+
+	o, err := parseESConf(map[string]string{"elasticsearch.url": "http://elasticsearch:9200", "elasticsearch.document_id": "false"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.add(rec)
+	if body := o.(*esOutput).body.String(); strings.Contains(body, "_id") {
+		t.Fatal("_id must not be sent, got", body)
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// esAuthorizer adds credentials to elasticsearch requests
+type esAuthorizer interface {
+	authorize(req *http.Request) error
+}
+
+// parseESAuth returns authorizer configured, nil if none configured
+func parseESAuth(m map[string]string) (esAuthorizer, error) {
+	var auths []esAuthorizer
+	if s, ok := m["elasticsearch.basicAuth"]; ok {
+		if strings.IndexByte(s, ':') == -1 {
+			return nil, errors.New("config: elasticsearch.basicAuth has invalid value")
+		}
+		auths = append(auths, headerAuth("Basic "+base64.StdEncoding.EncodeToString([]byte(s))))
+	}
+	if s, ok := m["elasticsearch.api_key"]; ok {
+		if s == "" {
+			return nil, errors.New("config: elasticsearch.api_key has invalid value")
+		}
+		if strings.IndexByte(s, ':') != -1 {
+			s = base64.StdEncoding.EncodeToString([]byte(s))
+		}
+		auths = append(auths, headerAuth("ApiKey "+s))
+	}
+	if s, ok := m["elasticsearch.bearer_token_file"]; ok {
+		a := &tokenFileAuth{file: s}
+		if err := a.reload(); err != nil {
+			return nil, errors.New("config: elasticsearch.bearer_token_file: " + err.Error())
+		}
+		auths = append(auths, a)
+	}
+	if s, ok := m["elasticsearch.aws.region"]; ok {
+		a := &sigv4Auth{region: s, service: "es"}
+		if s, ok := m["elasticsearch.aws.service"]; ok {
+			a.service = s
+		}
+		if a.region == "" || a.service == "" {
+			return nil, errors.New("config: elasticsearch.aws.region and elasticsearch.aws.service must not be empty")
+		}
+		switch {
+		case os.Getenv("AWS_ACCESS_KEY_ID") != "":
+			a.creds = envCredentials{}
+		case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+			w := &webIdentityCredentials{
+				endpoint:    "https://sts." + a.region + ".amazonaws.com",
+				roleARN:     os.Getenv("AWS_ROLE_ARN"),
+				sessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+				tokenFile:   os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"),
+			}
+			if s, ok := m["elasticsearch.aws.sts_endpoint"]; ok {
+				w.endpoint = strings.TrimSuffix(s, "/")
+			}
+			if w.sessionName == "" {
+				w.sessionName = "logflow"
+			}
+			a.creds = w
+		default:
+			return nil, errors.New("config: elasticsearch.aws.region requires AWS_ACCESS_KEY_ID or AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		auths = append(auths, a)
+	}
+	switch len(auths) {
+	case 0:
+		return nil, nil
+	case 1:
+		return auths[0], nil
+	}
+	return nil, errors.New("config: only one of elasticsearch.basicAuth, elasticsearch.api_key, elasticsearch.bearer_token_file, elasticsearch.aws.region can be used")
+}
+
+// esAuthTransport authorizes each request before sending it
+type esAuthTransport struct {
+	http.RoundTripper
+	auth esAuthorizer
+}
+
+func (t esAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify request
+	req = req.Clone(req.Context())
+	if err := t.auth.authorize(req); err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// headerAuth is static value of Authorization header
+type headerAuth string
+
+func (a headerAuth) authorize(req *http.Request) error {
+	req.Header.Set("Authorization", string(a))
+	return nil
+}
+
+// tokenFileAuth sends bearer token read from file. the file is
+// read again when its modification time or size changes, so that
+// rotated tokens are picked up.
+//
+// it is used only by elasticsearch output goroutine
+type tokenFileAuth struct {
+	file    string
+	modTime time.Time
+	size    int64
+	token   string
+}
+
+func (a *tokenFileAuth) reload() error {
+	fi, err := os.Stat(a.file)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return nil
+	}
+	b, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return errors.New("no token found in " + a.file)
+	}
+	a.modTime, a.size, a.token = fi.ModTime(), fi.Size(), token
+	return nil
+}
+
+// authorize uses previous token, if file cannot be read. the token might
+// still be valid, and elasticsearch responds with 401 otherwise
+func (a *tokenFileAuth) authorize(req *http.Request) error {
+	if err := a.reload(); err != nil {
+		warn("reloading elasticsearch bearer token failed:", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// sigv4Auth signs requests with AWS signature version 4, as
+// required by Amazon OpenSearch Service. service is "es" for
+// managed domains and "aoss" for serverless collections
+type sigv4Auth struct {
+	region, service string
+	creds           awsCredentialsProvider
+}
+
+func (a *sigv4Auth) authorize(req *http.Request) error {
+	c, err := a.creds.retrieve()
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = ioutil.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	a.sign(req, body, time.Now(), c)
+	return nil
+}
+
+func (a *sigv4Auth) sign(req *http.Request, body []byte, t time.Time, c awsCredentials) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + a.region + "/" + a.service + "/aws4_request"
+	payloadHash := hexSHA256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.service == "aoss" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	// sign host and x-amz-* headers
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// path is escaped twice, for services other than s3
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(path, true),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, s := range []string{amzDate[:8], a.region, a.service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsCredentials is access key, with session token for temporary credentials
+type awsCredentials struct {
+	accessKey, secretKey, sessionToken string
+	expires                            time.Time // zero, if never expires
+}
+
+type awsCredentialsProvider interface {
+	retrieve() (awsCredentials, error)
+}
+
+// envCredentials reads credentials from environment variables on
+// each request, so that credentials updated by the runtime are used
+type envCredentials struct{}
+
+func (envCredentials) retrieve() (awsCredentials, error) {
+	c := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return c, errors.New("aws: AWS_ACCESS_KEY_ID or AWS_SECRET_ACCESS_KEY missing")
+	}
+	return c, nil
+}
+
+// webIdentityCredentials exchanges service account token for temporary
+// credentials using sts AssumeRoleWithWebIdentity, as in IAM roles for
+// service accounts on EKS. credentials are refreshed before they expire.
+// the token file is read on each refresh, as kubelet rotates it.
+//
+// it is used only by elasticsearch output goroutine
+type webIdentityCredentials struct {
+	endpoint    string
+	roleARN     string
+	sessionName string
+	tokenFile   string
+	creds       awsCredentials
+}
+
+// awsRefreshWindow is how long before expiry, credentials are refreshed
+const awsRefreshWindow = 5 * time.Minute
+
+var stsClient = &http.Client{Timeout: 30 * time.Second}
+
+// retrieve uses current credentials, if refresh fails before they expire
+func (w *webIdentityCredentials) retrieve() (awsCredentials, error) {
+	now := time.Now()
+	if w.creds.accessKey != "" && now.Add(awsRefreshWindow).Before(w.creds.expires) {
+		return w.creds, nil
+	}
+	c, err := w.assumeRole()
+	if err != nil {
+		if w.creds.accessKey != "" && now.Before(w.creds.expires) {
+			warn("refreshing aws credentials failed:", err)
+			return w.creds, nil
+		}
+		return awsCredentials{}, err
+	}
+	w.creds = c
+	return c, nil
+}
+
+func (w *webIdentityCredentials) assumeRole() (awsCredentials, error) {
+	token, err := ioutil.ReadFile(w.tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {w.roleARN},
+		"RoleSessionName":  {w.sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(exitCtx, http.MethodPost, w.endpoint+"/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := stsClient.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("aws: AssumeRoleWithWebIdentity returned %s: %s", resp.Status, b)
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(b, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("aws: AssumeRoleWithWebIdentity: %v", err)
+	}
+	c := result.Credentials
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("aws: AssumeRoleWithWebIdentity returned no credentials")
+	}
+	return awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken, c.Expiration}, nil
+}
+
+func canonicalQuery(req *http.Request) string {
+	var params []string
+	for k, vv := range req.URL.Query() {
+		for _, v := range vv {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent encodes all bytes other than unreserved
+// characters as per RFC 3986
+func awsEscape(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hexDigits[c>>4])
+			buf.WriteByte(hexDigits[c&15])
+		}
+	}
+	return buf.String()
+}
+
+func hexSHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,354 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authServer records Authorization header of requests
+type authServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	auths []string
+}
+
+func newAuthServer(t *testing.T, h http.Handler) *authServer {
+	s := &authServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.auths = append(s.auths, r.Header.Get("Authorization"))
+		s.mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testESAuth(t *testing.T, conf map[string]string, h http.Handler) (*esOutput, *authServer) {
+	t.Helper()
+	restoreESConf(t)
+	srv := newAuthServer(t, h)
+	conf["elasticsearch.url"] = srv.URL
+	conf["elasticsearch.template"] = ""
+	o, err := parseESConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.(*esOutput), srv
+}
+
+func TestESAuthHeader(t *testing.T) {
+	tests := []struct {
+		key, value, want string
+	}{
+		{"elasticsearch.basicAuth", "user:pass", "Basic dXNlcjpwYXNz"},
+		{"elasticsearch.api_key", "id:key", "ApiKey aWQ6a2V5"},
+		{"elasticsearch.api_key", "aWQ6a2V5", "ApiKey aWQ6a2V5"},
+	}
+	for _, test := range tests {
+		o, srv := testESAuth(t, map[string]string{test.key: test.value}, newFakeES())
+		o.add(newESRecord(time.Now()))
+		o.flush()
+		if !reflect.DeepEqual(srv.auths, []string{test.want}) {
+			t.Errorf("%s=%s: got %q, want %q", test.key, test.value, srv.auths, test.want)
+		}
+	}
+}
+
+func TestESBearerTokenFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(file, []byte("token1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o, srv := testESAuth(t, map[string]string{"elasticsearch.bearer_token_file": file}, newFakeES())
+	send := func() {
+		t.Helper()
+		o.add(newESRecord(time.Now()))
+		if cancelled := o.flush(); cancelled {
+			t.Fatal("must not be cancelled")
+		}
+	}
+	send()
+
+	// rotated token is used
+	if err := ioutil.WriteFile(file, []byte("token2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	send()
+
+	// previous token is used, if file is missing
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	send()
+
+	want := []string{"Bearer token1", "Bearer token2", "Bearer token2"}
+	if !reflect.DeepEqual(srv.auths, want) {
+		t.Fatalf("got %q, want %q", srv.auths, want)
+	}
+}
+
+// test vectors from aws signature version 4 test suite
+func TestSigV4(t *testing.T) {
+	a := &sigv4Auth{region: "us-east-1", service: "service"}
+	creds := awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	tests := []struct {
+		method, url, signature string
+	}{
+		{"GET", "https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"POST", "https://example.amazonaws.com/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.sign(req, nil, now, creds)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + test.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s %s:\n got %s\nwant %s", test.method, test.url, got, want)
+		}
+		if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+			t.Errorf("%s %s: X-Amz-Date: got %s", test.method, test.url, got)
+		}
+	}
+}
+
+// sigv4Verifier rejects requests whose signature does not match
+// the one computed from received request with given credentials
+func sigv4Verifier(t *testing.T, a *sigv4Auth, c awsCredentials, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		amzDate, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, "invalid X-Amz-Date", http.StatusForbidden)
+			return
+		}
+		if a.service == "aoss" && r.Header.Get("X-Amz-Content-Sha256") != hexSHA256(body) {
+			http.Error(w, "invalid X-Amz-Content-Sha256", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("X-Amz-Security-Token") != c.sessionToken {
+			http.Error(w, "invalid X-Amz-Security-Token", http.StatusForbidden)
+			return
+		}
+		req := r.Clone(r.Context())
+		req.URL.Host = r.Host
+		a.sign(req, body, amzDate, c)
+		if got, want := r.Header.Get("Authorization"), req.Header.Get("Authorization"); got != want {
+			t.Errorf("signature mismatch for %s %s:\n got %s\nwant %s", r.Method, r.URL, got, want)
+			http.Error(w, "signature mismatch", http.StatusForbidden)
+			return
+		}
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func TestESSigV4(t *testing.T) {
+	for _, service := range []string{"es", "aoss"} {
+		t.Run(service, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+			t.Setenv("AWS_SESSION_TOKEN", "session")
+			a := &sigv4Auth{region: "eu-west-1", service: service}
+			c := awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "secret", sessionToken: "session"}
+			fake := newFakeES()
+			o, srv := testESAuth(t, map[string]string{
+				"elasticsearch.aws.region":   "eu-west-1",
+				"elasticsearch.aws.service":  service,
+				"elasticsearch.policy":       "logs",
+				"elasticsearch.distribution": "opensearch",
+			}, sigv4Verifier(t, a, c, fake))
+			o.add(newESRecord(time.Now()))
+			if cancelled := o.flush(); cancelled {
+				t.Fatal("must not be cancelled")
+			}
+			want := []string{"GET /_plugins/_ism/policies/logs", "PUT /_plugins/_ism/policies/logs", "POST /_bulk"}
+			if !reflect.DeepEqual(fake.requests, want) {
+				t.Fatal("got", fake.requests)
+			}
+			for _, auth := range srv.auths {
+				if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+					t.Fatal("got", auth)
+				}
+			}
+		})
+	}
+}
+
+// stsServer is fake sts, that returns given credentials one per request.
+// it fails, once all credentials are returned
+type stsServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	tokens []string // web identity tokens received
+	creds  []awsCredentials
+}
+
+func newSTSServer(t *testing.T, creds ...awsCredentials) *stsServer {
+	s := &stsServer{creds: creds}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("RoleArn") != "arn:aws:iam::123:role/logflow" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		s.tokens = append(s.tokens, r.FormValue("WebIdentityToken"))
+		if len(s.creds) == 0 {
+			http.Error(w, "<Error/>", http.StatusServiceUnavailable)
+			return
+		}
+		c := s.creds[0]
+		s.creds = s.creds[1:]
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+			<AssumeRoleWithWebIdentityResult><Credentials>
+				<AccessKeyId>%s</AccessKeyId>
+				<SecretAccessKey>%s</SecretAccessKey>
+				<SessionToken>%s</SessionToken>
+				<Expiration>%s</Expiration>
+			</Credentials></AssumeRoleWithWebIdentityResult>
+		</AssumeRoleWithWebIdentityResponse>`, c.accessKey, c.secretKey, c.sessionToken, c.expires.Format(time.RFC3339))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stsServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.tokens...)
+}
+
+func TestESSigV4WebIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123:role/logflow")
+	now := time.Now().Truncate(time.Second)
+	expiring := awsCredentials{"AKID1", "secret1", "session1", now.Add(time.Minute)}
+	fresh := awsCredentials{"AKID2", "secret2", "session2", now.Add(time.Hour)}
+	sts := newSTSServer(t, expiring, fresh)
+
+	// verify with credentials returned by sts, in order
+	a := &sigv4Auth{region: "us-east-1", service: "es"}
+	var mu sync.Mutex
+	want := []awsCredentials{expiring, fresh, fresh}
+	fake := newFakeES()
+	o, _ := testESAuth(t, map[string]string{
+		"elasticsearch.aws.region":       "us-east-1",
+		"elasticsearch.aws.sts_endpoint": sts.URL + "/",
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		c := want[0]
+		want = want[1:]
+		mu.Unlock()
+		sigv4Verifier(t, a, c, fake).ServeHTTP(w, r)
+	}))
+	send := func() {
+		t.Helper()
+		o.add(newESRecord(time.Now()))
+		if cancelled := o.flush(); cancelled {
+			t.Fatal("must not be cancelled")
+		}
+	}
+	send()
+
+	// credentials expiring soon are refreshed, using rotated token
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	send()
+
+	// fresh credentials are reused
+	send()
+	if got := sts.received(); !reflect.DeepEqual(got, []string{"jwt1", "jwt2"}) {
+		t.Fatal("sts: got", got)
+	}
+	if !reflect.DeepEqual(fake.requests, []string{"POST /_bulk", "POST /_bulk", "POST /_bulk"}) {
+		t.Fatal("got", fake.requests)
+	}
+}
+
+func TestWebIdentityRefreshFailure(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expiring := awsCredentials{"AKID1", "secret1", "session1", time.Now().Add(time.Minute)}
+	sts := newSTSServer(t, expiring)
+	w := &webIdentityCredentials{
+		endpoint:    sts.URL,
+		roleARN:     "arn:aws:iam::123:role/logflow",
+		sessionName: "logflow",
+		tokenFile:   tokenFile,
+	}
+	c, err := w.retrieve()
+	if err != nil || c.accessKey != "AKID1" || !c.expires.Equal(expiring.expires.Truncate(time.Second)) {
+		t.Fatal("got", c, err)
+	}
+
+	// current credentials are used, until they expire
+	if c, err = w.retrieve(); err != nil || c.accessKey != "AKID1" {
+		t.Fatal("got", c, err)
+	}
+	w.creds.expires = time.Now()
+	if _, err = w.retrieve(); err == nil {
+		t.Fatal("error expected")
+	}
+	if got := sts.received(); len(got) != 3 {
+		t.Fatal("sts: got", got)
+	}
+}
+
+func TestParseESAuthError(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	tests := []map[string]string{
+		{"elasticsearch.basicAuth": "user"},
+		{"elasticsearch.api_key": ""},
+		{"elasticsearch.bearer_token_file": filepath.Join(t.TempDir(), "missing")},
+		{"elasticsearch.aws.region": "us-east-1"},
+		{"elasticsearch.basicAuth": "user:pass", "elasticsearch.api_key": "key"},
+	}
+	for _, m := range tests {
+		if _, err := parseESAuth(m); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+}
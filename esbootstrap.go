@@ -0,0 +1,376 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/json"
+)
+
+// options
+var (
+	esDistribution = "elasticsearch" // or opensearch
+	esTemplate     = esTemplateConf{name: "logflow", priority: 200, replicas: -1}
+	esPolicy       = esPolicyConf{rolloverSize: "50gb", rolloverAge: "1d", deleteAfter: "30d"}
+	rolloverAlias  = ""
+)
+
+type esTemplateConf struct {
+	name     string // empty if disabled
+	patterns []string
+	priority int
+	shards   int
+	replicas int // -1 if not specified
+}
+
+// esPolicyConf is ILM policy in elasticsearch and ISM policy in opensearch
+type esPolicyConf struct {
+	name         string // empty if disabled
+	rolloverSize string
+	rolloverAge  string
+	deleteAfter  string // empty if indices are never deleted
+}
+
+func parseESBootstrapConf(m map[string]string) error {
+	if s, ok := m["elasticsearch.distribution"]; ok {
+		if s != "elasticsearch" && s != "opensearch" {
+			return errors.New("config: invalid elasticsearch.distribution " + s)
+		}
+		esDistribution = s
+	}
+	if s, ok := m["elasticsearch.rollover_alias"]; ok && s != "" {
+		if dataStream != nil {
+			return errors.New("config: elasticsearch.rollover_alias cannot be used with data streams")
+		}
+		rolloverAlias = sanitizeIndex(s)
+	}
+
+	if s, ok := m["elasticsearch.template"]; ok {
+		esTemplate.name = s
+	}
+	esTemplate.patterns = nil
+	if s, ok := m["elasticsearch.template.patterns"]; ok {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				esTemplate.patterns = append(esTemplate.patterns, p)
+			}
+		}
+	} else {
+		esTemplate.patterns = defaultIndexPatterns()
+	}
+	ints := []struct {
+		key string
+		ptr *int
+		def int
+	}{
+		{"elasticsearch.template.priority", &esTemplate.priority, 200},
+		{"elasticsearch.template.shards", &esTemplate.shards, 0},
+		{"elasticsearch.template.replicas", &esTemplate.replicas, -1},
+	}
+	for _, opt := range ints {
+		*opt.ptr = opt.def
+		if s, ok := m[opt.key]; ok {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 {
+				return errors.New("config: invalid " + opt.key + " " + s)
+			}
+			*opt.ptr = i
+		}
+	}
+
+	esPolicy.name = m["elasticsearch.policy"]
+	strs := []struct {
+		key string
+		ptr *string
+	}{
+		{"elasticsearch.policy.rollover_size", &esPolicy.rolloverSize},
+		{"elasticsearch.policy.rollover_age", &esPolicy.rolloverAge},
+		{"elasticsearch.policy.delete_after", &esPolicy.deleteAfter},
+	}
+	for _, opt := range strs {
+		if s, ok := m[opt.key]; ok {
+			*opt.ptr = s
+		}
+	}
+	return nil
+}
+
+func (t esTemplateConf) indexPatterns() []interface{} {
+	patterns := make([]interface{}, len(t.patterns))
+	for i, p := range t.patterns {
+		patterns[i] = p
+	}
+	return patterns
+}
+
+// defaultIndexPatterns returns patterns matching indices written
+// by logflow, excluding those routed by rules and annotations
+func defaultIndexPatterns() []string {
+	switch {
+	case dataStream != nil:
+		return []string{indexPattern(dataStream)}
+	case rolloverAlias != "":
+		return []string{rolloverAlias + "-*"}
+	}
+	patterns := []string{indexPattern(esIndex)}
+	if esFallback != nil {
+		if p := indexPattern(esFallback); p != patterns[0] {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// indexPattern returns wildcard pattern matching names expanded from t
+func indexPattern(t template) string {
+	var buf strings.Builder
+	for _, p := range t {
+		if p.isLit() {
+			buf.WriteString(replaceIndexChars(p.lit))
+		} else if !strings.HasSuffix(buf.String(), "*") {
+			buf.WriteByte('*')
+		}
+	}
+	return buf.String()
+}
+
+// bootstrapES installs policy, index template and rollover alias.
+// it is idempotent, and called before first bulk request, and
+// after elasticsearch becomes reachable again.
+//
+// network failures and 429/5xx responses are returned as error,
+// so that the caller retries. other failures are logged and ignored,
+// to avoid blocking shipping of logs
+func bootstrapES() error {
+	if esPolicy.name != "" {
+		if err := putPolicy(); err != nil {
+			return err
+		}
+	}
+	if esTemplate.name != "" {
+		_, err := esRequest(http.MethodPut, "/_index_template/"+url.PathEscape(esTemplate.name), indexTemplate())
+		if err != nil {
+			return err
+		}
+	}
+	if rolloverAlias != "" {
+		return createWriteIndex()
+	}
+	return nil
+}
+
+func indexTemplate() map[string]interface{} {
+	labels := "flattened"
+	if esDistribution == "opensearch" {
+		labels = "flat_object"
+	}
+	keyword := map[string]interface{}{"type": "keyword"}
+	mappings := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"@timestamp": map[string]interface{}{"type": "date"},
+			"@message":   map[string]interface{}{"type": "text"},
+			"@level":     keyword,
+			"@severity":  map[string]interface{}{"type": "byte"},
+			"@k8s": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"namespace":      keyword,
+					"pod":            keyword,
+					"container_name": keyword,
+					"container_id":   keyword,
+					"nodename":       keyword,
+					"labels":         map[string]interface{}{"type": labels},
+				},
+			},
+		},
+	}
+	settings := make(map[string]interface{})
+	if esTemplate.shards > 0 {
+		settings["index.number_of_shards"] = esTemplate.shards
+	}
+	if esTemplate.replicas >= 0 {
+		settings["index.number_of_replicas"] = esTemplate.replicas
+	}
+	if esPolicy.name != "" && esDistribution == "elasticsearch" {
+		settings["index.lifecycle.name"] = esPolicy.name
+		if rolloverAlias != "" {
+			settings["index.lifecycle.rollover_alias"] = rolloverAlias
+		}
+	}
+	if esPolicy.name != "" && esDistribution == "opensearch" && rolloverAlias != "" {
+		settings["plugins.index_state_management.rollover_alias"] = rolloverAlias
+	}
+	t := map[string]interface{}{
+		"index_patterns": esTemplate.indexPatterns(),
+		"priority":       esTemplate.priority,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{"managed_by": "logflow"},
+	}
+	if dataStream != nil {
+		t["data_stream"] = map[string]interface{}{}
+	}
+	return t
+}
+
+// rollover returns true if indices are rolled over by policy
+func rollover() bool {
+	return dataStream != nil || rolloverAlias != ""
+}
+
+func putPolicy() error {
+	if esDistribution == "opensearch" {
+		return putISMPolicy()
+	}
+	phases := make(map[string]interface{})
+	hot := make(map[string]interface{})
+	if rollover() {
+		hot["rollover"] = esPolicy.rolloverConditions("max_size", "max_age")
+	}
+	phases["hot"] = map[string]interface{}{"actions": hot}
+	if esPolicy.deleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": esPolicy.deleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	_, err := esRequest(http.MethodPut, "/_ilm/policy/"+url.PathEscape(esPolicy.name), map[string]interface{}{
+		"policy": map[string]interface{}{"phases": phases},
+	})
+	return err
+}
+
+func (p esPolicyConf) rolloverConditions(size, age string) map[string]interface{} {
+	m := make(map[string]interface{})
+	if p.rolloverSize != "" {
+		m[size] = p.rolloverSize
+	}
+	if p.rolloverAge != "" {
+		m[age] = p.rolloverAge
+	}
+	return m
+}
+
+// putISMPolicy creates or updates opensearch ISM policy.
+// updating existing policy requires its seq_no and primary_term
+func putISMPolicy() error {
+	path := "/_plugins/_ism/policies/" + url.PathEscape(esPolicy.name)
+	resp, err := esRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		seqNo, _ := resp["_seq_no"].(float64)
+		term, _ := resp["_primary_term"].(float64)
+		path += fmt.Sprintf("?if_seq_no=%d&if_primary_term=%d", int64(seqNo), int64(term))
+	}
+
+	hot, transitions := []interface{}{}, []interface{}{}
+	if rollover() {
+		hot = append(hot, map[string]interface{}{"rollover": esPolicy.rolloverConditions("min_size", "min_index_age")})
+	}
+	if esPolicy.deleteAfter != "" {
+		transitions = append(transitions, map[string]interface{}{
+			"state_name": "delete",
+			"conditions": map[string]interface{}{"min_index_age": esPolicy.deleteAfter},
+		})
+	}
+	states := []interface{}{
+		map[string]interface{}{"name": "hot", "actions": hot, "transitions": transitions},
+	}
+	if esPolicy.deleteAfter != "" {
+		states = append(states, map[string]interface{}{
+			"name":        "delete",
+			"actions":     []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}},
+			"transitions": []interface{}{},
+		})
+	}
+	_, err = esRequest(http.MethodPut, path, map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "managed by logflow",
+			"default_state": "hot",
+			"states":        states,
+			"ism_template": []interface{}{
+				map[string]interface{}{"index_patterns": esTemplate.indexPatterns(), "priority": esTemplate.priority},
+			},
+		},
+	})
+	return err
+}
+
+// createWriteIndex creates first index of rollover alias, if alias
+// does not exist. index already existing is not treated as error,
+// because other logflow instances might have created it
+func createWriteIndex() error {
+	resp, err := esRequest(http.MethodGet, "/_alias/"+url.PathEscape(rolloverAlias), nil)
+	if err != nil || resp != nil {
+		return err
+	}
+	_, err = esRequest(http.MethodPut, "/"+url.PathEscape(rolloverAlias+"-000001"), map[string]interface{}{
+		"aliases": map[string]interface{}{
+			rolloverAlias: map[string]interface{}{"is_write_index": true},
+		},
+	})
+	return err
+}
+
+// esRequest sends request with json body to elasticsearch, and returns
+// decoded response. nil response is returned for 404 and for failures
+// that are logged and ignored. see bootstrapES
+func esRequest(method, path string, body map[string]interface{}) (map[string]interface{}, error) {
+	var b []byte
+	var header http.Header
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			panic(err)
+		}
+		header = http.Header{"Content-Type": {"application/json"}}
+	}
+	resp, err := esNodes.do(method, path, b, header)
+	if err != nil {
+		return nil, err
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return nil, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, fmt.Errorf("elasticsearch returned %s for %s %s", resp.Status, method, path)
+	case resp.StatusCode > 299:
+		if !bytes.Contains(b, []byte("resource_already_exists_exception")) {
+			warn("elasticsearch returned", resp.Status, "for", method, path, string(b))
+		}
+		return nil, nil
+	}
+	m, err := jsonUnmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("elasticsearch response for %s %s: %v", method, path, err)
+	}
+	return m, nil
+}
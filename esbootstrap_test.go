@@ -0,0 +1,229 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeES records requests as "METHOD PATH" and their bodies.
+// responses maps "METHOD PATH" to status codes, used one per request.
+// zero status closes the connection, as if elasticsearch is down
+type fakeES struct {
+	mu        sync.Mutex
+	requests  []string
+	bodies    map[string]map[string]interface{}
+	responses map[string][]int
+	existing  map[string]string // body of GET response by path
+}
+
+func newFakeES() *fakeES {
+	return &fakeES{
+		bodies:    make(map[string]map[string]interface{}),
+		responses: make(map[string][]int),
+		existing:  make(map[string]string),
+	}
+}
+
+func (es *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	req := r.Method + " " + r.URL.Path
+	es.requests = append(es.requests, req)
+	if statuses := es.responses[req]; len(statuses) > 0 {
+		es.responses[req] = statuses[1:]
+		if statuses[0] == 0 {
+			c, _, _ := w.(http.Hijacker).Hijack()
+			_ = c.Close()
+			return
+		}
+		w.WriteHeader(statuses[0])
+		_, _ = w.Write([]byte(`{"error":"failed"}`))
+		return
+	}
+	if r.URL.RawQuery != "" {
+		es.requests[len(es.requests)-1] += "?" + r.URL.RawQuery
+	}
+	b, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodGet:
+		if body, ok := es.existing[r.URL.Path]; ok {
+			_, _ = w.Write([]byte(body))
+		} else {
+			http.Error(w, `{"status":404}`, http.StatusNotFound)
+		}
+	case r.URL.Path == "/_bulk":
+		_, _ = w.Write([]byte(`{"took":1,"errors":false,"items":[]}`))
+	default:
+		m, err := jsonUnmarshal(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		es.bodies[r.URL.Path] = m
+		_, _ = w.Write([]byte(`{"acknowledged":true}`))
+	}
+}
+
+// restoreESConf restores elasticsearch options at the end of test
+func restoreESConf(t *testing.T) {
+	nodes, opType, ds, prefix := esNodes, esOpType, dataStream, indexPrefix
+	dist, tmpl, policy, alias := esDistribution, esTemplate, esPolicy, rolloverAlias
+	date, zone, granularity, docID := indexDate, indexZone, indexGranularity, esDocID
+	transport := esClient.Transport
+	t.Cleanup(func() {
+		esClient.Transport = transport
+		esNodes, esOpType, dataStream, indexPrefix = nodes, opType, ds, prefix
+		esDistribution, esTemplate, esPolicy, rolloverAlias = dist, tmpl, policy, alias
+		indexDate, indexZone, indexGranularity, esDocID = date, zone, granularity, docID
+	})
+}
+
+func testESBootstrap(t *testing.T, conf map[string]string, fake *fakeES) *esOutput {
+	t.Helper()
+	restoreESConf(t)
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	conf["elasticsearch.url"] = srv.URL
+	o, err := parseESConf(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.(*esOutput)
+}
+
+func TestBootstrapES(t *testing.T) {
+	fake := newFakeES()
+	o := testESBootstrap(t, map[string]string{"elasticsearch.template.replicas": "1"}, fake)
+	o.add(newESRecord(time.Now()))
+	if cancelled := o.flush(); cancelled {
+		t.Fatal("must not be cancelled")
+	}
+	want := []string{"PUT /_index_template/logflow", "POST /_bulk"}
+	if !reflect.DeepEqual(fake.requests, want) {
+		t.Fatal("got", fake.requests)
+	}
+	tmpl := fake.bodies["/_index_template/logflow"]
+	if !reflect.DeepEqual(tmpl["index_patterns"], []interface{}{"logflow-*"}) {
+		t.Fatal("index_patterns: got", tmpl["index_patterns"])
+	}
+	labels, _ := lookupField(tmpl, "template.mappings.properties.@k8s.properties.labels.type")
+	if labels != "flattened" {
+		t.Fatal("labels: got", labels)
+	}
+	if replicas, _ := lookupField(tmpl, "template.settings.index.number_of_replicas"); replicas != float64(1) {
+		t.Fatal("replicas: got", replicas)
+	}
+
+	// bootstrapped only once
+	o.add(newESRecord(time.Now()))
+	o.flush()
+	if len(fake.requests) != 3 {
+		t.Fatal("got", fake.requests)
+	}
+
+	// bootstrap again, after elasticsearch is reachable
+	fake.requests = nil
+	fake.responses["POST /_bulk"] = []int{0}
+	o.add(newESRecord(time.Now()))
+	o.flush()
+	want = []string{"POST /_bulk", "PUT /_index_template/logflow", "POST /_bulk"}
+	if !reflect.DeepEqual(fake.requests, want) {
+		t.Fatal("got", fake.requests)
+	}
+}
+
+func TestBootstrapESRollover(t *testing.T) {
+	fake := newFakeES()
+	fake.responses["PUT /_index_template/logs"] = []int{http.StatusServiceUnavailable}
+	o := testESBootstrap(t, map[string]string{
+		"elasticsearch.template":       "logs",
+		"elasticsearch.policy":         "logs",
+		"elasticsearch.rollover_alias": "logs",
+	}, fake)
+	o.add(newESRecord(time.Now()))
+	if !strings.HasPrefix(o.body.String(), `{"index":{"_index":"logs",`) {
+		t.Fatal("must write to rollover alias, got", o.body.String())
+	}
+	o.flush()
+	want := []string{
+		"PUT /_ilm/policy/logs",
+		"PUT /_index_template/logs", // 503 retried
+		"PUT /_ilm/policy/logs",
+		"PUT /_index_template/logs",
+		"GET /_alias/logs",
+		"PUT /logs-000001",
+		"POST /_bulk",
+	}
+	if !reflect.DeepEqual(fake.requests, want) {
+		t.Fatal("got", fake.requests)
+	}
+	policy := fake.bodies["/_ilm/policy/logs"]
+	if v, _ := lookupField(policy, "policy.phases.hot.actions.rollover.max_size"); v != "50gb" {
+		t.Fatal("rollover: got", policy)
+	}
+	if v, _ := lookupField(policy, "policy.phases.delete.min_age"); v != "30d" {
+		t.Fatal("delete: got", policy)
+	}
+	tmpl := fake.bodies["/_index_template/logs"]
+	if v, _ := lookupField(tmpl, "template.settings.index.lifecycle.rollover_alias"); v != "logs" {
+		t.Fatal("settings: got", tmpl["template"])
+	}
+	if v, _ := lookupField(fake.bodies["/logs-000001"], "aliases.logs.is_write_index"); v != true {
+		t.Fatal("write index: got", fake.bodies["/logs-000001"])
+	}
+}
+
+func TestBootstrapOpenSearch(t *testing.T) {
+	fake := newFakeES()
+	fake.existing["/_plugins/_ism/policies/logs"] = `{"_id":"logs","_seq_no":7,"_primary_term":2,"policy":{}}`
+	o := testESBootstrap(t, map[string]string{
+		"elasticsearch.distribution": "opensearch",
+		"elasticsearch.policy":       "logs",
+		"elasticsearch.data_stream":  "logs-{namespace}-default",
+	}, fake)
+	o.add(newESRecord(time.Now()))
+	o.flush()
+	want := []string{
+		"GET /_plugins/_ism/policies/logs",
+		"PUT /_plugins/_ism/policies/logs?if_seq_no=7&if_primary_term=2",
+		"PUT /_index_template/logflow",
+		"POST /_bulk",
+	}
+	if !reflect.DeepEqual(fake.requests, want) {
+		t.Fatal("got", fake.requests)
+	}
+	tmpl := fake.bodies["/_index_template/logflow"]
+	if !reflect.DeepEqual(tmpl["index_patterns"], []interface{}{"logs-*-default"}) {
+		t.Fatal("index_patterns: got", tmpl["index_patterns"])
+	}
+	if _, ok := tmpl["data_stream"]; !ok {
+		t.Fatal("data_stream missing in template")
+	}
+	if v, _ := lookupField(tmpl, "template.mappings.properties.@k8s.properties.labels.type"); v != "flat_object" {
+		t.Fatal("labels: got", v)
+	}
+	policy := fake.bodies["/_plugins/_ism/policies/logs"]
+	if v, _ := lookupField(policy, "policy.default_state"); v != "hot" {
+		t.Fatal("got", policy)
+	}
+}
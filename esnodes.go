@@ -0,0 +1,285 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var esNodes = newESPool([]string{"http://elasticsearch:9200"}, 0)
+
+// esPool is pool of elasticsearch nodes. requests are sent to nodes
+// in round robin. node failing with network error is ejected for
+// duration that doubles on each consecutive failure.
+//
+// it is used only by elasticsearch output goroutine
+type esPool struct {
+	seeds     []string // configured urls
+	nodes     []*esNode
+	next      int
+	scheme    string
+	sniff     time.Duration // zero if sniffing is disabled
+	sniffedAt time.Time
+}
+
+type esNode struct {
+	url       string
+	failures  int
+	deadUntil time.Time
+}
+
+const maxEjectTime = 2 * time.Minute
+
+func newESPool(urls []string, sniff time.Duration) *esPool {
+	p := &esPool{seeds: urls, sniff: sniff}
+	if u, err := url.Parse(urls[0]); err == nil {
+		p.scheme = u.Scheme
+	}
+	p.setNodes(urls)
+	return p
+}
+
+// parseESURLs parses comma separated list of urls
+func parseESURLs(s string) ([]string, error) {
+	var urls []string
+	for _, s := range strings.Split(s, ",") {
+		s = strings.TrimSuffix(strings.TrimSpace(s), "/")
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("invalid url " + s)
+		}
+		urls = append(urls, s)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no url specified")
+	}
+	return urls, nil
+}
+
+// setNodes replaces nodes with given urls, retaining
+// state of nodes which are already in pool
+func (p *esPool) setNodes(urls []string) {
+	old := make(map[string]*esNode)
+	for _, n := range p.nodes {
+		old[n.url] = n
+	}
+	p.nodes = p.nodes[:0]
+	for _, u := range urls {
+		n, ok := old[u]
+		if !ok {
+			n = &esNode{url: u}
+		}
+		p.nodes = append(p.nodes, n)
+	}
+	p.next %= len(p.nodes)
+}
+
+// pick returns next live node. if all nodes are ejected,
+// the one that is to be revived earliest is returned
+func (p *esPool) pick() *esNode {
+	now := time.Now()
+	var earliest *esNode
+	for range p.nodes {
+		n := p.nodes[p.next]
+		p.next = (p.next + 1) % len(p.nodes)
+		if !now.Before(n.deadUntil) {
+			return n
+		}
+		if earliest == nil || n.deadUntil.Before(earliest.deadUntil) {
+			earliest = n
+		}
+	}
+	return earliest
+}
+
+func (p *esPool) allEjected() bool {
+	now := time.Now()
+	for _, n := range p.nodes {
+		if !now.Before(n.deadUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSeeds tells whether nodes are same as seeds
+func (p *esPool) hasSeeds() bool {
+	if len(p.nodes) != len(p.seeds) {
+		return false
+	}
+	for i, n := range p.nodes {
+		if n.url != p.seeds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *esNode) failed(err error) {
+	if n.failures == 0 {
+		warn("elasticsearch node", n.url, "ejected:", err)
+	}
+	n.failures++
+	wait := maxEjectTime
+	if n.failures <= 7 {
+		wait = time.Second << uint(n.failures-1)
+	}
+	if wait > maxEjectTime {
+		wait = maxEjectTime
+	}
+	n.deadUntil = time.Now().Add(wait)
+}
+
+func (n *esNode) succeeded() {
+	if n.failures > 0 {
+		info("elasticsearch node", n.url, "is reachable")
+		n.failures, n.deadUntil = 0, time.Time{}
+	}
+}
+
+// do sends request to nodes until one of them responds. on network
+// failure or 5xx response, node is ejected and request is sent to next
+// node immediately. if all nodes fail, last 5xx response is returned,
+// otherwise error of last node
+func (p *esPool) do(method, path string, body []byte, header http.Header) (*http.Response, error) {
+	if p.sniff > 0 && p.allEjected() && !p.hasSeeds() {
+		// sniffed nodes might have moved, fall back to seeds and sniff again
+		warn("all elasticsearch nodes are ejected, falling back to", strings.Join(p.seeds, ","))
+		p.setNodes(p.seeds)
+		p.sniffedAt = time.Time{}
+	}
+	if p.sniff > 0 && time.Since(p.sniffedAt) >= p.sniff {
+		p.sniffedAt = time.Now()
+		p.sniffNodes()
+	}
+	var err error
+	var last *http.Response // last 5xx response
+	for range p.nodes {
+		n := p.pick()
+		var resp *http.Response
+		resp, err = n.do(method, path, body, header)
+		switch {
+		case err == context.Canceled:
+			closeResponse(last)
+			return nil, err
+		case err == nil && resp.StatusCode < 500:
+			closeResponse(last)
+			n.succeeded()
+			return resp, nil
+		case err == nil:
+			closeResponse(last)
+			last, err = resp, errors.New(resp.Status)
+		}
+		n.failed(err)
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+func closeResponse(resp *http.Response) {
+	if resp != nil {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+}
+
+func (n *esNode) do(method, path string, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(exitCtx, method, n.url+path, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := esClient.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == context.Canceled {
+			return nil, uerr.Err
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// sniffNodes replaces nodes with those returned by _nodes/http api.
+// nodes are not changed on failure
+func (p *esPool) sniffNodes() {
+	resp, err := p.do(http.MethodGet, "/_nodes/http", nil, nil)
+	if err != nil {
+		if err != context.Canceled {
+			warn("sniffing elasticsearch nodes failed:", err)
+		}
+		return
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		warn("sniffing elasticsearch nodes failed:", err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		warn("sniffing elasticsearch nodes failed:", resp.Status)
+		return
+	}
+	m, err := jsonUnmarshal(b)
+	if err != nil {
+		warn("sniffing elasticsearch nodes failed:", err)
+		return
+	}
+	nodes, _ := m["nodes"].(map[string]interface{})
+	var urls []string
+	for _, node := range nodes {
+		node, _ := node.(map[string]interface{})
+		addr, _ := lookupField(node, "http.publish_address")
+		if s, ok := addr.(string); ok && s != "" {
+			urls = append(urls, p.scheme+"://"+publishAddress(s))
+		}
+	}
+	if len(urls) == 0 {
+		warn("sniffing elasticsearch nodes returned no nodes")
+		return
+	}
+	sort.Strings(urls)
+	p.setNodes(urls)
+}
+
+// publishAddress converts publish_address of form hostname/ip:port
+// to hostname:port, and ip:port is returned as is
+func publishAddress(s string) string {
+	i := strings.IndexByte(s, '/')
+	if i == -1 {
+		return s
+	}
+	host, addr := s[:i], s[i+1:]
+	if _, port, err := net.SplitHostPort(addr); err == nil && host != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return addr
+}
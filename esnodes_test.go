@@ -0,0 +1,255 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingServer counts requests received
+type countingServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newCountingServer(t *testing.T, h http.HandlerFunc) *countingServer {
+	s := &countingServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		s.mu.Unlock()
+		if h != nil {
+			h(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *countingServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func doGet(t *testing.T, p *esPool) {
+	t.Helper()
+	resp, err := p.do(http.MethodGet, "/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+}
+
+func TestESPoolRoundRobin(t *testing.T) {
+	s1, s2 := newCountingServer(t, nil), newCountingServer(t, nil)
+	p := newESPool([]string{s1.URL, s2.URL}, 0)
+	for i := 0; i < 4; i++ {
+		doGet(t, p)
+	}
+	if s1.count() != 2 || s2.count() != 2 {
+		t.Fatal("got", s1.count(), s2.count())
+	}
+}
+
+func TestESPoolFailover(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := newCountingServer(t, nil)
+	p := newESPool([]string{dead.URL, live.URL}, 0)
+
+	// failed request is sent to next node immediately
+	doGet(t, p)
+	if live.count() != 1 {
+		t.Fatal("got", live.count())
+	}
+	n := p.nodes[0]
+	if n.failures != 1 || !n.deadUntil.After(time.Now()) {
+		t.Fatal("dead node must be ejected")
+	}
+
+	// ejected node is skipped
+	doGet(t, p)
+	doGet(t, p)
+	if live.count() != 3 {
+		t.Fatal("got", live.count())
+	}
+
+	// ejected node is retried after eject time, which doubles
+	n.deadUntil = time.Now()
+	doGet(t, p)
+	if n.failures != 2 || n.deadUntil.Sub(time.Now()) < 1500*time.Millisecond {
+		t.Fatal("eject time must double, got", n.deadUntil.Sub(time.Now()))
+	}
+
+	// node responding with 5xx is ejected
+	unavailable := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	p = newESPool([]string{unavailable.URL, live.URL}, 0)
+	doGet(t, p)
+	if unavailable.count() != 1 || live.count() != 5 || p.nodes[0].failures != 1 {
+		t.Fatal("got", unavailable.count(), live.count(), p.nodes[0].failures)
+	}
+
+	// 5xx response is returned, if all nodes respond with 5xx
+	p = newESPool([]string{unavailable.URL}, 0)
+	resp, err := p.do(http.MethodGet, "/", nil, nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("got", resp, err)
+	}
+	_ = resp.Body.Close()
+
+	// all nodes failed
+	p = newESPool([]string{dead.URL}, 0)
+	if _, err := p.do(http.MethodGet, "/", nil, nil); err == nil {
+		t.Fatal("error expected")
+	}
+	if p.pick() != p.nodes[0] {
+		t.Fatal("ejected node must be picked, when all nodes are ejected")
+	}
+}
+
+func TestESPoolSniff(t *testing.T) {
+	s2 := newCountingServer(t, nil)
+	var s1 *countingServer
+	s1 = newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/http" {
+			addr1 := strings.TrimPrefix(s1.URL, "http://")
+			addr2 := strings.TrimPrefix(s2.URL, "http://")
+			fmt.Fprintf(w, `{"nodes":{
+				"n1":{"http":{"publish_address":"%s"}},
+				"n2":{"http":{"publish_address":"localhost/%s"}},
+				"n3":{"name":"no http"}
+			}}`, addr1, addr2)
+		}
+	})
+	p := newESPool([]string{s1.URL}, time.Hour)
+	doGet(t, p)
+	var urls []string
+	for _, n := range p.nodes {
+		urls = append(urls, n.url)
+	}
+	want := []string{s1.URL, strings.Replace(s2.URL, "127.0.0.1", "localhost", 1)}
+	if !reflect.DeepEqual(urls, want) {
+		t.Fatalf("got %v, want %v", urls, want)
+	}
+	doGet(t, p)
+	doGet(t, p)
+	if s1.count() != 3 || s2.count() != 1 {
+		t.Fatal("must sniff once per interval, got", s1.count(), s2.count())
+	}
+}
+
+func TestESPoolSniffFallback(t *testing.T) {
+	sniffed := newCountingServer(t, nil)
+	var mu sync.Mutex
+	publish := strings.TrimPrefix(sniffed.URL, "http://")
+	seed := newCountingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_nodes/http" {
+			mu.Lock()
+			defer mu.Unlock()
+			fmt.Fprintf(w, `{"nodes":{"n1":{"http":{"publish_address":"%s"}}}}`, publish)
+		}
+	})
+	p := newESPool([]string{seed.URL}, time.Hour)
+	doGet(t, p)
+	if len(p.nodes) != 1 || p.nodes[0].url != sniffed.URL {
+		t.Fatal("got", p.nodes[0].url)
+	}
+
+	// sniffed node is dead, and cluster now publishes seed
+	sniffed.Close()
+	mu.Lock()
+	publish = strings.TrimPrefix(seed.URL, "http://")
+	mu.Unlock()
+	if _, err := p.do(http.MethodGet, "/", nil, nil); err == nil {
+		t.Fatal("error expected")
+	}
+
+	// falls back to seeds, when all sniffed nodes are ejected
+	doGet(t, p)
+	if len(p.nodes) != 1 || p.nodes[0].url != seed.URL {
+		t.Fatal("got", p.nodes[0].url)
+	}
+	if seed.count() != 3 {
+		t.Fatal("must sniff again using seeds, got", seed.count())
+	}
+}
+
+func TestESOutputFailover(t *testing.T) {
+	restoreESConf(t)
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	fake := newFakeES()
+	live := httptest.NewServer(fake)
+	defer live.Close()
+	o, err := parseESConf(map[string]string{
+		"elasticsearch.url":      dead.URL + ", " + live.URL + "/",
+		"elasticsearch.template": "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.add(newESRecord(time.Now()))
+	start := time.Now()
+	if cancelled := o.flush(); cancelled {
+		t.Fatal("must not be cancelled")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("must not wait before trying next node, took", d)
+	}
+	if !reflect.DeepEqual(fake.requests, []string{"POST /_bulk"}) {
+		t.Fatal("got", fake.requests)
+	}
+}
+
+func TestParseESURLs(t *testing.T) {
+	urls, err := parseESURLs(" http://es-0:9200/, https://es-1:9200 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://es-0:9200", "https://es-1:9200"}; !reflect.DeepEqual(urls, want) {
+		t.Fatal("got", urls)
+	}
+	for _, s := range []string{"", ",", "es-0:9200", "ftp://es-0", "http://"} {
+		if _, err := parseESURLs(s); err == nil {
+			t.Errorf("%q: error expected", s)
+		}
+	}
+}
+
+func TestPublishAddress(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1:9200":           "10.0.0.1:9200",
+		"es-0.es/10.0.0.1:9200":   "es-0.es:9200",
+		"/10.0.0.1:9200":          "10.0.0.1:9200",
+		"es-0/[2001:db8::1]:9200": "es-0:9200",
+		"[2001:db8::1]:9200":      "[2001:db8::1]:9200",
+	}
+	for s, want := range tests {
+		if got := publishAddress(s); got != want {
+			t.Errorf("publishAddress(%q): got %q, want %q", s, got, want)
+		}
+	}
+}
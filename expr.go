@@ -0,0 +1,702 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// expression language ---
+//
+// a small CEL like language evaluated on log records. it has no
+// loops and no side effects, so evaluation is bounded by the size
+// of expression. expressions are compiled once and evaluated many times.
+//
+//	literals:    "str", 'str', 12, 1.5, true, false, null, [1, 2]
+//	fields:      @message, status, app.user, @k8s.labels.app, @k8s.labels["app-name"]
+//	operators:   || && ! == != < <= > >= in + - * / %
+//	methods:     s.startsWith(x) s.endsWith(x) s.contains(x) s.matches("re") s.lower() s.upper() x.size()
+//	functions:   has(field) size(x) string(x) number(x)
+//
+// missing fields evaluate to null. operations on values of
+// unexpected types evaluate to null instead of failing
+
+// exprEnv is the environment in which expression is evaluated
+type exprEnv struct {
+	rec map[string]interface{}
+	k8s map[string]interface{}
+}
+
+type node interface {
+	eval(env *exprEnv) interface{}
+}
+
+func compileExpr(s string) (node, error) {
+	p := &exprParser{lex: exprLexer{s: s}}
+	p.next()
+	n, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.s)
+	}
+	return n, nil
+}
+
+// evalBool tells whether n evaluates to true
+func evalBool(n node, env *exprEnv) bool {
+	b, _ := n.eval(env).(bool)
+	return b
+}
+
+// lexer ---
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokStr
+	tokNum
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	s    string
+	v    interface{}
+	pos  int
+}
+
+type exprLexer struct {
+	s   string
+	pos int
+}
+
+var exprOps = []string{"=>", "||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "."}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '@' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.s) && (l.s[l.pos] == ' ' || l.s[l.pos] == '\t') {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.s) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+	c := l.s[l.pos]
+	switch {
+	case isIdentStart(c):
+		for l.pos < len(l.s) && isIdentPart(l.s[l.pos]) {
+			l.pos++
+		}
+		return token{kind: tokIdent, s: l.s[start:l.pos], pos: start}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.s) && (l.s[l.pos] == '.' || (l.s[l.pos] >= '0' && l.s[l.pos] <= '9')) {
+			l.pos++
+		}
+		f, err := strconv.ParseFloat(l.s[start:l.pos], 64)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid number %q", l.s[start:l.pos])
+		}
+		return token{kind: tokNum, s: l.s[start:l.pos], v: f, pos: start}, nil
+	case c == '"' || c == '\'':
+		l.pos++
+		for l.pos < len(l.s) && l.s[l.pos] != c {
+			if l.s[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.s) {
+			return token{}, errors.New("unterminated string")
+		}
+		l.pos++
+		q := l.s[start:l.pos]
+		if c == '\'' {
+			q = `"` + strings.ReplaceAll(strings.ReplaceAll(q[1:len(q)-1], `\'`, `'`), `"`, `\"`) + `"`
+		}
+		s, err := strconv.Unquote(q)
+		if err != nil {
+			return token{}, fmt.Errorf("invalid string %s", l.s[start:l.pos])
+		}
+		return token{kind: tokStr, s: l.s[start:l.pos], v: s, pos: start}, nil
+	}
+	for _, op := range exprOps {
+		if strings.HasPrefix(l.s[l.pos:], op) {
+			l.pos += len(op)
+			return token{kind: tokOp, s: op, pos: start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q", c)
+}
+
+// parser ---
+
+type exprParser struct {
+	lex exprLexer
+	tok token
+	err error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, a...), p.tok.pos)
+}
+
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.s == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("%q expected", op)
+	}
+	p.next()
+	return p.err
+}
+
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "in": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *exprParser) parse() (node, error) {
+	return p.parseBinary(1)
+}
+
+func (p *exprParser) binaryOp() (string, int) {
+	if p.tok.kind == tokOp || (p.tok.kind == tokIdent && p.tok.s == "in") {
+		if prec, ok := precedence[p.tok.s]; ok {
+			return p.tok.s, prec
+		}
+	}
+	return "", 0
+}
+
+func (p *exprParser) parseBinary(minPrec int) (node, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec := p.binaryOp()
+		if prec < minPrec || prec == 0 {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{op: op, x: x, y: y}
+	}
+}
+
+func (p *exprParser) parseUnary() (node, error) {
+	if p.isOp("!") || p.isOp("-") {
+		op := p.tok.s
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: op, x: x}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (node, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("identifier expected")
+			}
+			name := p.tok.s
+			p.next()
+			if p.isOp("(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				if x, err = newCall(name, x, args); err != nil {
+					return nil, err
+				}
+			} else if f, ok := x.(*fieldNode); ok {
+				f.path += "." + name
+			} else {
+				x = &indexNode{x: x, i: &literalNode{name}}
+			}
+		case p.isOp("["):
+			p.next()
+			i, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &indexNode{x: x, i: i}
+		default:
+			return x, p.err
+		}
+	}
+}
+
+func (p *exprParser) parseArgs() ([]node, error) {
+	p.next() // (
+	var args []node
+	for !p.isOp(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	return args, p.err
+}
+
+func (p *exprParser) parsePrimary() (node, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	t := p.tok
+	switch t.kind {
+	case tokStr, tokNum:
+		p.next()
+		return &literalNode{t.v}, nil
+	case tokIdent:
+		p.next()
+		switch t.s {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		}
+		if p.isOp("(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return newCall(t.s, nil, args)
+		}
+		return &fieldNode{path: t.s}, nil
+	case tokOp:
+		switch t.s {
+		case "(":
+			p.next()
+			x, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			args, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return &listNode{args}, nil
+		}
+	case tokEOF:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", t.s)
+}
+
+func (p *exprParser) parseList() ([]node, error) {
+	p.next() // [
+	var items []node
+	for !p.isOp("]") {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		item, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	p.next()
+	return items, p.err
+}
+
+// nodes ---
+
+type literalNode struct {
+	v interface{}
+}
+
+func (n *literalNode) eval(*exprEnv) interface{} {
+	return n.v
+}
+
+// fieldNode is dotted path of a field
+type fieldNode struct {
+	path string
+}
+
+func (n *fieldNode) eval(env *exprEnv) interface{} {
+	v, _ := n.lookup(env)
+	return v
+}
+
+func (n *fieldNode) lookup(env *exprEnv) (interface{}, bool) {
+	if n.path == "@k8s" {
+		return env.k8s, true
+	}
+	if strings.HasPrefix(n.path, "@k8s.") {
+		return lookupField(env.k8s, n.path[len("@k8s."):])
+	}
+	return lookupField(env.rec, n.path)
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(env *exprEnv) interface{} {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		list[i] = item.eval(env)
+	}
+	return list
+}
+
+type indexNode struct {
+	x, i node
+}
+
+func (n *indexNode) eval(env *exprEnv) interface{} {
+	switch x := n.x.eval(env).(type) {
+	case map[string]interface{}:
+		if k, ok := n.i.eval(env).(string); ok {
+			return x[k]
+		}
+	case []interface{}:
+		if f, ok := toNumber(n.i.eval(env)); ok && f >= 0 && int(f) < len(x) {
+			return x[int(f)]
+		}
+	}
+	return nil
+}
+
+type unaryNode struct {
+	op string
+	x  node
+}
+
+func (n *unaryNode) eval(env *exprEnv) interface{} {
+	if n.op == "!" {
+		return !evalBool(n.x, env)
+	}
+	if f, ok := toNumber(n.x.eval(env)); ok {
+		return -f
+	}
+	return nil
+}
+
+type binaryNode struct {
+	op   string
+	x, y node
+}
+
+func (n *binaryNode) eval(env *exprEnv) interface{} {
+	switch n.op {
+	case "&&":
+		return evalBool(n.x, env) && evalBool(n.y, env)
+	case "||":
+		return evalBool(n.x, env) || evalBool(n.y, env)
+	}
+	x, y := n.x.eval(env), n.y.eval(env)
+	switch n.op {
+	case "==":
+		return equal(x, y)
+	case "!=":
+		return !equal(x, y)
+	case "in":
+		switch y := y.(type) {
+		case []interface{}:
+			for _, item := range y {
+				if equal(x, item) {
+					return true
+				}
+			}
+		case map[string]interface{}:
+			if k, ok := x.(string); ok {
+				_, ok = y[k]
+				return ok
+			}
+		}
+		return false
+	case "<", "<=", ">", ">=":
+		c, ok := compareValues(x, y)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		}
+		return c >= 0
+	}
+	fx, okx := toNumber(x)
+	fy, oky := toNumber(y)
+	if !okx || !oky {
+		if n.op == "+" && x != nil && y != nil {
+			_, sx := x.(string)
+			_, sy := y.(string)
+			if sx || sy {
+				return sprint(x) + sprint(y)
+			}
+		}
+		return nil
+	}
+	switch n.op {
+	case "+":
+		return fx + fy
+	case "-":
+		return fx - fy
+	case "*":
+		return fx * fy
+	case "/":
+		if fy == 0 {
+			return nil
+		}
+		return fx / fy
+	case "%":
+		if int64(fy) == 0 {
+			return nil
+		}
+		return float64(int64(fx) % int64(fy))
+	}
+	return nil
+}
+
+type callNode struct {
+	name string
+	recv node // nil for functions
+	args []node
+	re   *regexp.Regexp
+}
+
+var exprFuncs = map[string]int{
+	"has":    1,
+	"size":   1,
+	"string": 1,
+	"number": 1,
+}
+
+var exprMethods = map[string]int{
+	"startsWith": 1,
+	"endsWith":   1,
+	"contains":   1,
+	"matches":    1,
+	"lower":      0,
+	"upper":      0,
+	"size":       0,
+}
+
+func newCall(name string, recv node, args []node) (node, error) {
+	funcs := exprFuncs
+	if recv != nil {
+		funcs = exprMethods
+	}
+	nargs, ok := funcs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	if len(args) != nargs {
+		return nil, fmt.Errorf("%s expects %d arguments", name, nargs)
+	}
+	n := &callNode{name: name, recv: recv, args: args}
+	switch name {
+	case "has":
+		if _, ok := args[0].(*fieldNode); !ok {
+			return nil, errors.New("has expects field")
+		}
+	case "matches":
+		var s string
+		if lit, ok := args[0].(*literalNode); ok {
+			s, ok = lit.v.(string)
+		}
+		if s == "" {
+			return nil, errors.New("matches expects string literal")
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		n.re = re
+	}
+	return n, nil
+}
+
+func (n *callNode) eval(env *exprEnv) interface{} {
+	if n.recv == nil {
+		switch n.name {
+		case "has":
+			_, ok := n.args[0].(*fieldNode).lookup(env)
+			return ok
+		case "size":
+			return size(n.args[0].eval(env))
+		case "string":
+			if v := n.args[0].eval(env); v != nil {
+				return sprint(v)
+			}
+			return nil
+		case "number":
+			if f, ok := toNumber(n.args[0].eval(env)); ok {
+				return f
+			}
+			if s, ok := n.args[0].eval(env).(string); ok {
+				if f, err := strconv.ParseFloat(s, 64); err == nil {
+					return f
+				}
+			}
+			return nil
+		}
+	}
+	recv := n.recv.eval(env)
+	if n.name == "size" {
+		return size(recv)
+	}
+	s, ok := recv.(string)
+	if !ok {
+		return nil
+	}
+	switch n.name {
+	case "lower":
+		return strings.ToLower(s)
+	case "upper":
+		return strings.ToUpper(s)
+	case "matches":
+		return n.re.MatchString(s)
+	}
+	arg, ok := n.args[0].eval(env).(string)
+	if !ok {
+		return nil
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(s, arg)
+	case "endsWith":
+		return strings.HasSuffix(s, arg)
+	}
+	return strings.Contains(s, arg)
+}
+
+// values ---
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func equal(x, y interface{}) bool {
+	if fx, ok := toNumber(x); ok {
+		fy, ok := toNumber(y)
+		return ok && fx == fy
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func compareValues(x, y interface{}) (int, bool) {
+	if fx, ok := toNumber(x); ok {
+		if fy, ok := toNumber(y); ok {
+			switch {
+			case fx < fy:
+				return -1, true
+			case fx > fy:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if sx, ok := x.(string); ok {
+		if sy, ok := y.(string); ok {
+			// same as filter, so that levels are ordered by severity
+			return compare(sx, sy), true
+		}
+	}
+	return 0, false
+}
+
+func size(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return float64(len(v))
+	case []interface{}:
+		return float64(len(v))
+	case map[string]interface{}:
+		return float64(len(v))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	env := &exprEnv{
+		rec: map[string]interface{}{
+			"@message":   "GET /health 200",
+			"@level":     "debug",
+			"status":     float64(503),
+			"error.type": "java.io.IOException",
+			"user":       map[string]interface{}{"name": "Alice", "roles": []interface{}{"admin"}},
+		},
+		k8s: map[string]interface{}{
+			"namespace": "team-a-prod",
+			"labels":    map[string]interface{}{"app": "web", "app-tier": "frontend", "canary": "true"},
+		},
+	}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{`@k8s.namespace.startsWith("team-a") && @level == "debug"`, true},
+		{`@k8s.labels.canary != "true"`, false},
+		{`@k8s.labels["app-tier"] == 'frontend'`, true},
+		{`status >= 500 && status < 600`, true},
+		{`status > "500"`, false},
+		{`@level < "warn" && @level >= "trace"`, true},
+		{`"error" >= "warn"`, true},
+		{`"10" > "9"`, true},
+		{`"b" > "a"`, true},
+		{`status + 1`, float64(504)},
+		{`-status * 2 / 4 % 100`, float64(-51)},
+		{`"team-" + @k8s.namespace`, "team-team-a-prod"},
+		{`"s" + status`, "s503"},
+		{`@message.matches("^GET /health")`, true},
+		{`@message.contains("POST") || !has(missing)`, true},
+		{`has(error.type) && error.type.endsWith("IOException")`, true},
+		{`user.name.lower() in ["alice", "bob"]`, true},
+		{`"admin" in user.roles`, true},
+		{`"app" in @k8s.labels`, true},
+		{`size(user.roles) == 1 && @level.size() == 5`, true},
+		{`user.roles[0].upper()`, "ADMIN"},
+		{`missing == null`, true},
+		{`missing.x.startsWith("a")`, nil},
+		{`number("12") + 1`, float64(13)},
+		{`string(status)`, "503"},
+		{`1 + 2 * 3 == 7`, true},
+		{`(1 + 2) * 3`, float64(9)},
+		{`status / 0`, nil},
+	}
+	for _, test := range tests {
+		n, err := compileExpr(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expr, err)
+		}
+		if got := n.eval(env); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestCompileExprError(t *testing.T) {
+	tests := []string{
+		``,
+		`a ==`,
+		`(a`,
+		`[1, 2`,
+		`"abc`,
+		`a.foo()`,
+		`exec("rm")`,
+		`a.matches(b)`,
+		`a.matches("[")`,
+		`has("a")`,
+		`a b`,
+		`a # b`,
+		`1.2.3`,
+	}
+	for _, s := range tests {
+		if _, err := compileExpr(s); err == nil {
+			t.Errorf("%q: error expected", s)
+		}
+	}
+}
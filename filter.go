@@ -0,0 +1,231 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// options
+var globalFilter *filter
+
+// filter decides which log records are dropped
+type filter struct {
+	dropIf []condition // drop if any matches
+	keepIf []condition // drop if none matches
+}
+
+func parseFilter(m map[string]string, prefix string) (*filter, error) {
+	f := &filter{}
+	var err error
+	if s, ok := m[prefix+"drop_if"]; ok {
+		if f.dropIf, err = parseConditions(s); err != nil {
+			return nil, errors.New(prefix + "drop_if: " + err.Error())
+		}
+	}
+	if s, ok := m[prefix+"keep_if"]; ok {
+		if f.keepIf, err = parseConditions(s); err != nil {
+			return nil, errors.New(prefix + "keep_if: " + err.Error())
+		}
+	}
+	if len(f.dropIf) == 0 && len(f.keepIf) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// drop tells whether rec should be dropped. k8s
+// is used to resolve fields with prefix "@k8s."
+func (f *filter) drop(rec, k8s map[string]interface{}) bool {
+	if f == nil {
+		return false
+	}
+	for _, c := range f.dropIf {
+		if c.match(rec, k8s) {
+			return true
+		}
+	}
+	if len(f.keepIf) == 0 {
+		return false
+	}
+	for _, c := range f.keepIf {
+		if c.match(rec, k8s) {
+			return false
+		}
+	}
+	return true
+}
+
+// condition ---
+
+type condition struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+var ops = []string{"=~", "!~", "==", "!=", ">=", "<=", ">", "<", "="}
+
+// parseConditions parses conditions separated by ';'
+// for example: @message=~/healthz/; @level<warn
+func parseConditions(s string) ([]condition, error) {
+	var conds []condition
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			break
+		}
+		i := strings.IndexAny(s, "=!<>")
+		if i <= 0 {
+			return nil, errors.New("field missing in " + s)
+		}
+		c := condition{field: strings.TrimSpace(s[:i])}
+		s = s[i:]
+		for _, op := range ops {
+			if strings.HasPrefix(s, op) {
+				c.op = op
+				break
+			}
+		}
+		if c.op == "" {
+			return nil, errors.New("invalid operator in " + s)
+		}
+		s = strings.TrimSpace(s[len(c.op):])
+		if c.op == "=" {
+			c.op = "=="
+		}
+		if c.op == "=~" || c.op == "!~" {
+			end := regexEnd(s)
+			if end == -1 {
+				return nil, errors.New("regex must be enclosed with '/'")
+			}
+			re, err := compileRegex(s[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			c.re, s = re, strings.TrimSpace(s[end+1:])
+			if s != "" && s[0] != ';' {
+				return nil, errors.New("';' expected before " + s)
+			}
+		} else {
+			semi := strings.IndexByte(s, ';')
+			if semi == -1 {
+				semi = len(s)
+			}
+			c.value, s = strings.TrimSpace(s[:semi]), s[semi:]
+		}
+		if s != "" {
+			s = s[1:]
+		}
+		conds = append(conds, c)
+	}
+	if len(conds) == 0 {
+		return nil, errors.New("no conditions")
+	}
+	return conds, nil
+}
+
+// regexEnd returns index of '/' which terminates regex in s
+func regexEnd(s string) int {
+	if !strings.HasPrefix(s, "/") {
+		return -1
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '/':
+			return i
+		}
+	}
+	return -1
+}
+
+func (c condition) match(rec, k8s map[string]interface{}) bool {
+	var v interface{}
+	var ok bool
+	if strings.HasPrefix(c.field, "@k8s.") {
+		v, ok = lookupField(k8s, c.field[len("@k8s."):])
+	} else {
+		v, ok = lookupField(rec, c.field)
+	}
+	if !ok {
+		return c.op == "!=" || c.op == "!~"
+	}
+	s := sprint(v)
+	switch c.op {
+	case "=~":
+		return c.re.MatchString(s)
+	case "!~":
+		return !c.re.MatchString(s)
+	case "==":
+		return s == c.value
+	case "!=":
+		return s != c.value
+	}
+	cmp := compare(s, c.value)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp < 0
+	}
+}
+
+// compare compares level names by severity, numbers
+// numerically and everything else lexically
+func compare(x, y string) int {
+	if sx, sy := severities[levelAliases[strings.ToLower(x)]], severities[levelAliases[strings.ToLower(y)]]; sx > 0 && sy > 0 {
+		return sx - sy
+	}
+	if fx, err := strconv.ParseFloat(x, 64); err == nil {
+		if fy, err := strconv.ParseFloat(y, 64); err == nil {
+			switch {
+			case fx < fy:
+				return -1
+			case fx > fy:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(x, y)
+}
+
+// lookupField finds value of field in m. nested objects
+// are looked up using dotted path, such as labels.app
+func lookupField(m map[string]interface{}, field string) (interface{}, bool) {
+	if v, ok := m[field]; ok {
+		return v, true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] == '.' {
+			if sub, ok := m[field[:i]].(map[string]interface{}); ok {
+				if v, ok := lookupField(sub, field[i+1:]); ok {
+					return v, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
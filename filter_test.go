@@ -0,0 +1,64 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	k8s := map[string]interface{}{
+		"namespace": "team-a",
+		"labels":    map[string]interface{}{"app": "web"},
+	}
+	tests := []struct {
+		name string
+		conf map[string]string
+		rec  map[string]interface{}
+		drop bool
+	}{
+		{"noFilter", nil, map[string]interface{}{"@message": "GET /healthz"}, false},
+		{"dropRegex", map[string]string{"drop_if": "@message=~/healthz/"}, map[string]interface{}{"@message": "GET /healthz"}, true},
+		{"dropRegexNoMatch", map[string]string{"drop_if": "@message=~/healthz/"}, map[string]interface{}{"@message": "GET /api"}, false},
+		{"dropRegexWithSemicolon", map[string]string{"drop_if": `@message=~/a\/b;c/; status==200`}, map[string]interface{}{"@message": "x", "status": int64(200)}, true},
+		{"keepLevel", map[string]string{"keep_if": "@level>=warn"}, map[string]interface{}{"@level": "error"}, false},
+		{"keepLevelLow", map[string]string{"keep_if": "@level>=warn"}, map[string]interface{}{"@level": "info"}, true},
+		{"keepMissing", map[string]string{"keep_if": "@level>=warn"}, map[string]interface{}{"@message": "x"}, true},
+		{"numeric", map[string]string{"drop_if": "latency<10"}, map[string]interface{}{"latency": 9.5}, true},
+		{"numericNotLexical", map[string]string{"drop_if": "latency<10"}, map[string]interface{}{"latency": float64(100)}, false},
+		{"k8s", map[string]string{"drop_if": "@k8s.labels.app=web"}, map[string]interface{}{}, true},
+		{"nested", map[string]string{"drop_if": "app.user!=bob"}, map[string]interface{}{"app": map[string]interface{}{"user": "alice"}}, true},
+		{"dropWins", map[string]string{"drop_if": "@message=~/x/", "keep_if": "@level>=warn"}, map[string]interface{}{"@message": "x", "@level": "error"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFilter(tt.conf, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.drop(tt.rec, k8s); got != tt.drop {
+				t.Fatal("got", got, "want", tt.drop)
+			}
+		})
+	}
+}
+
+func TestParseConditionsError(t *testing.T) {
+	for _, s := range []string{"", "@message", "=x", "@message=~healthz", "@message=~/a/ b", "@message=~/a(/"} {
+		if _, err := parseConditions(s); err == nil {
+			t.Fatalf("%q: error expected", s)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 module github.com/santhosh-tekuri/logflow
 
-go 1.13
+go 1.19
 
 require (
 	github.com/fsnotify/fsnotify v1.4.7
+	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.16.7
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/santhosh-tekuri/json v0.0.0-20210115065359-693f76ed46ef
-	golang.org/x/sys v0.0.0-20190916202348-b4ddaad3f8a3 // indirect
 )
+
+require golang.org/x/sys v0.0.0-20190916202348-b4ddaad3f8a3 // indirect
@@ -0,0 +1,395 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/santhosh-tekuri/json"
+)
+
+// kafkaOutput produces records to kafka with acks=all.
+//
+// topic is chosen per record using template. records are keyed
+// by pod name, so that logs of a pod go to same partition
+type kafkaOutput struct {
+	brokers   []string
+	topic     template
+	codec     int8
+	clientID  string
+	tls       *tls.Config
+	sasl      func() (saslMechanism, error)
+	batchSize int
+	dropped   int // records dropped as their topic does not exist
+	zenc      *zstd.Encoder
+
+	msgs  map[string][]kafkaMessage // by topic
+	size  int
+	meta  *kafkaMetadata
+	conns map[string]*kafkaConn // by broker address
+}
+
+func parseKafkaConf(m map[string]string) (output, error) {
+	s, ok := m["kafka.brokers"]
+	if !ok {
+		return nil, errors.New("config: kafka.brokers missing")
+	}
+	o := &kafkaOutput{
+		clientID:  "logflow",
+		codec:     codecNone,
+		batchSize: 1024 * 1024,
+		msgs:      make(map[string][]kafkaMessage),
+		conns:     make(map[string]*kafkaConn),
+	}
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			o.brokers = append(o.brokers, b)
+		}
+	}
+	topic := "logflow"
+	if s, ok = m["kafka.topic"]; ok {
+		topic = s
+	}
+	var err error
+	if o.topic, err = compileTemplate(topic); err != nil {
+		return nil, fmt.Errorf("config: invalid kafka.topic: %v", err)
+	}
+	if s, ok = m["kafka.client_id"]; ok {
+		o.clientID = s
+	}
+	if s, ok = m["kafka.compression"]; ok {
+		if o.codec, ok = kafkaCodecs[s]; !ok {
+			return nil, errors.New("config: invalid kafka.compression " + s)
+		}
+		if o.codec == codecZstd {
+			if o.zenc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s, ok = m["kafka.batch_size"]; ok {
+		kb, err := strconv.Atoi(s)
+		if err != nil || kb <= 0 {
+			return nil, errors.New("config: invalid kafka.batch_size " + s)
+		}
+		o.batchSize = kb * 1024
+	}
+	if s, ok = m["kafka.tls"]; ok && s == "true" {
+		o.tls = &tls.Config{InsecureSkipVerify: true}
+		if s, ok = m["kafka.cacert"]; ok {
+			b, err := ioutil.ReadFile(s)
+			if err != nil {
+				return nil, err
+			}
+			certPool := x509.NewCertPool()
+			certPool.AppendCertsFromPEM(b)
+			o.tls.InsecureSkipVerify = false
+			o.tls.RootCAs = certPool
+		}
+		if s, ok = m["kafka.clientcert"]; ok {
+			key, ok := m["kafka.clientkey"]
+			if !ok {
+				return nil, errors.New("config: kafka.clientkey missing")
+			}
+			clientCert, err := tls.LoadX509KeyPair(s, key)
+			if err != nil {
+				return nil, err
+			}
+			o.tls.Certificates = []tls.Certificate{clientCert}
+		}
+	}
+	if s, ok = m["kafka.sasl.mechanism"]; ok {
+		user, pass := m["kafka.sasl.username"], m["kafka.sasl.password"]
+		if _, err := newSASLMechanism(s, user, pass); err != nil {
+			return nil, fmt.Errorf("config: %v", err)
+		}
+		o.sasl = func() (saslMechanism, error) {
+			return newSASLMechanism(s, user, pass)
+		}
+	}
+	return o, nil
+}
+
+func (o *kafkaOutput) add(rec record) (full bool) {
+	value, err := json.Marshal(rec.doc)
+	if err != nil {
+		panic(err)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.doc["@timestamp"].(string))
+	if err != nil {
+		ts = time.Now()
+	}
+	topic, _ := o.topic.expand(rec.k8s, ts)
+	topic = sanitizeTopic(topic)
+	pod, _ := rec.k8s["pod"].(string)
+	o.msgs[topic] = append(o.msgs[topic], kafkaMessage{
+		key:   []byte(pod),
+		value: value,
+		ts:    ts.UnixNano() / int64(time.Millisecond),
+	})
+	o.size += len(pod) + len(value)
+	return o.size >= o.batchSize
+}
+
+// sanitizeTopic replaces characters not allowed in topic name with '_'
+func sanitizeTopic(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '.' || c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 249 {
+		b = b[:249]
+	}
+	if len(b) == 0 || string(b) == "." || string(b) == ".." {
+		return "logflow"
+	}
+	return string(b)
+}
+
+func (o *kafkaOutput) flush() (cancelled bool) {
+	if len(o.msgs) == 0 {
+		return false
+	}
+	if cancelled := retry("kafka", o.produce); cancelled {
+		return true
+	}
+	o.size = 0
+	return false
+}
+
+// produce sends pending messages to partition leaders. messages
+// acknowledged by brokers are removed, so that only the remaining
+// are sent on retry
+func (o *kafkaOutput) produce() error {
+	if o.meta == nil {
+		if err := o.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	meta := o.meta
+
+	// group messages by leader and partition. messages of topics
+	// which do not exist are dropped, so that they do not block others
+	var failed error
+	pending := make(map[string][]kafkaMessage)
+	byLeader := make(map[int32]map[topicPartition][]kafkaMessage)
+	for topic, msgs := range o.msgs {
+		n, ok := meta.partitions[topic]
+		if !ok {
+			kerr, ok := meta.errors[topic]
+			if ok && kerr == errLeaderNotAvailable {
+				// topic is being created
+				o.meta = nil
+				failed = fmt.Errorf("%v for topic %s", kerr, topic)
+				pending[topic] = msgs
+				continue
+			}
+			if !ok {
+				kerr = errUnknownTopic
+			}
+			o.dropped += len(msgs)
+			warn(fmt.Sprintf("dropping %d records to %s with error %v, %d dropped so far", len(msgs), topic, kerr, o.dropped))
+			continue
+		}
+		for _, msg := range msgs {
+			tp := topicPartition{topic, partitionOf(msg.key, n)}
+			leader, ok := meta.leaders[tp]
+			if !ok || leader < 0 {
+				o.meta = nil
+				failed = fmt.Errorf("kafka: no leader for %s[%d]", tp.topic, tp.partition)
+				pending[topic] = append(pending[topic], msg)
+				continue
+			}
+			if byLeader[leader] == nil {
+				byLeader[leader] = make(map[topicPartition][]kafkaMessage)
+			}
+			byLeader[leader][tp] = append(byLeader[leader][tp], msg)
+		}
+	}
+
+	for leader, group := range byLeader {
+		errs, err := o.produceTo(meta.brokers[leader], group)
+		if err != nil {
+			o.meta = nil
+			failed = err
+			for tp, msgs := range group {
+				pending[tp.topic] = append(pending[tp.topic], msgs...)
+			}
+			continue
+		}
+		for tp, msgs := range group {
+			kerr, ok := errs[tp]
+			if !ok {
+				kerr = kafkaError(13) // missing in response
+			}
+			switch {
+			case kerr == 0:
+			case kerr.retriable():
+				o.meta = nil
+				failed = fmt.Errorf("%v for %s[%d]", kerr, tp.topic, tp.partition)
+				pending[tp.topic] = append(pending[tp.topic], msgs...)
+			default:
+				warn("producing", len(msgs), "records to", fmt.Sprintf("%s[%d]", tp.topic, tp.partition), "failed with error", kerr)
+			}
+		}
+	}
+	o.msgs = pending
+	return failed
+}
+
+func (o *kafkaOutput) produceTo(addr string, group map[topicPartition][]kafkaMessage) (map[topicPartition]kafkaError, error) {
+	if addr == "" {
+		return nil, errors.New("kafka: unknown leader")
+	}
+	batches := make(map[topicPartition][]byte, len(group))
+	for tp, msgs := range group {
+		b, err := encodeRecordBatch(msgs, o.codec, o.zenc)
+		if err != nil {
+			panic(err)
+		}
+		batches[tp] = b
+	}
+	c, err := o.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	version := produceVersion(o.codec)
+	d, err := c.roundTrip(apiProduce, version, encodeProduceRequest(batches))
+	if err != nil {
+		o.closeConn(addr)
+		return nil, err
+	}
+	errs, err := decodeProduceResponse(d, version)
+	if err != nil {
+		o.closeConn(addr)
+	}
+	return errs, err
+}
+
+func (o *kafkaOutput) refreshMetadata() error {
+	topics := make([]string, 0, len(o.msgs))
+	for topic := range o.msgs {
+		topics = append(topics, topic)
+	}
+	req := encodeMetadataRequest(topics)
+	var lastErr error
+	for _, addr := range o.brokers {
+		c, err := o.conn(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		d, err := c.roundTrip(apiMetadata, kafkaMetadataVersion, req)
+		if err == nil {
+			var md *kafkaMetadata
+			if md, err = decodeMetadataResponse(d); err == nil {
+				o.meta = md
+				return nil
+			}
+		}
+		o.closeConn(addr)
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (o *kafkaOutput) conn(addr string) (*kafkaConn, error) {
+	if c, ok := o.conns[addr]; ok {
+		return c, nil
+	}
+	dialer := &net.Dialer{Timeout: 20 * time.Second, KeepAlive: 30 * time.Second}
+	nc, err := dialer.DialContext(exitCtx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.tls != nil {
+		config := o.tls.Clone()
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		nc = tls.Client(nc, config)
+	}
+	c := &kafkaConn{Conn: nc, clientID: o.clientID}
+	if o.sasl != nil {
+		if err := o.authenticate(c); err != nil {
+			_ = nc.Close()
+			return nil, err
+		}
+	}
+	o.conns[addr] = c
+	return c, nil
+}
+
+func (o *kafkaOutput) closeConn(addr string) {
+	if c, ok := o.conns[addr]; ok {
+		_ = c.Close()
+		delete(o.conns, addr)
+	}
+}
+
+func (o *kafkaOutput) authenticate(c *kafkaConn) error {
+	mech, err := o.sasl()
+	if err != nil {
+		return err
+	}
+	e := &kafkaEncoder{}
+	e.string(mech.name())
+	d, err := c.roundTrip(apiSaslHandshake, 1, e.b)
+	if err != nil {
+		return err
+	}
+	if kerr := kafkaError(d.int16()); kerr != 0 {
+		return kerr
+	}
+	var challenge []byte
+	for {
+		resp, done, err := mech.step(challenge)
+		if err != nil {
+			return err
+		}
+		if resp == nil && done {
+			return nil
+		}
+		e := &kafkaEncoder{}
+		e.bytes(resp)
+		d, err := c.roundTrip(apiSaslAuthenticate, 0, e.b)
+		if err != nil {
+			return err
+		}
+		kerr := kafkaError(d.int16())
+		msg := d.string()
+		challenge = d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		if kerr != 0 {
+			return fmt.Errorf("%v: %s", kerr, msg)
+		}
+		if done {
+			return nil
+		}
+	}
+}
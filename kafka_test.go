@@ -0,0 +1,652 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// stubBroker is single node kafka cluster, that understands
+// requests sent by kafkaOutput. every topic has 3 partitions.
+// produce requests are answered with errs, one per request,
+// before accepting them
+type stubBroker struct {
+	ln         net.Listener
+	mechanism  string
+	user, pass string
+
+	mu        sync.Mutex
+	errs      []kafkaError
+	topicErrs map[string]kafkaError // topic error in metadata response
+	produces  int
+	metadata  int
+	codecs    map[int8]bool
+	msgs      map[topicPartition][]kafkaMessage
+}
+
+const stubPartitions = 3
+
+// start must be called after configuring the broker
+func (b *stubBroker) start(t *testing.T) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.ln = ln
+	b.codecs = make(map[int8]bool)
+	b.msgs = make(map[topicPartition][]kafkaMessage)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+}
+
+// received returns number of messages accepted
+func (b *stubBroker) received() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, msgs := range b.msgs {
+		n += len(msgs)
+	}
+	return n
+}
+
+func (b *stubBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *stubBroker) serve(c net.Conn) {
+	defer c.Close()
+	var sasl *scramServer
+	authenticated := b.mechanism == ""
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		d := &kafkaDecoder{b: req}
+		apiKey, version, corrID := d.int16(), d.int16(), d.int32()
+		_ = d.string() // client id
+		if !authenticated && apiKey != apiSaslHandshake && apiKey != apiSaslAuthenticate {
+			return
+		}
+		e := &kafkaEncoder{}
+		e.int32(0)
+		e.int32(corrID)
+		switch apiKey {
+		case apiMetadata:
+			b.handleMetadata(d, e)
+		case apiProduce:
+			if err := b.handleProduce(d, e, version); err != nil {
+				return
+			}
+		case apiSaslHandshake:
+			mech := d.string()
+			if mech != b.mechanism {
+				e.int16(33) // UNSUPPORTED_SASL_MECHANISM
+			} else {
+				e.int16(0)
+			}
+			e.int32(1)
+			e.string(b.mechanism)
+			if strings.HasPrefix(mech, "SCRAM-") {
+				sasl = newScramServer(mech, b.user, b.pass)
+			}
+		case apiSaslAuthenticate:
+			var (
+				resp []byte
+				done bool
+				err  error
+			)
+			if sasl != nil {
+				resp, done, err = sasl.step(d.bytes())
+			} else {
+				done = bytes.Equal(d.bytes(), []byte("\x00"+b.user+"\x00"+b.pass))
+				if !done {
+					err = errors.New("invalid credentials")
+				}
+			}
+			if err != nil {
+				e.int16(58) // SASL_AUTHENTICATION_FAILED
+				e.string(err.Error())
+			} else {
+				e.int16(0)
+				e.int16(-1)
+			}
+			e.bytes(resp)
+			authenticated = done
+		default:
+			return
+		}
+		binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+		if _, err := c.Write(e.b); err != nil {
+			return
+		}
+	}
+}
+
+func (b *stubBroker) handleMetadata(d *kafkaDecoder, e *kafkaEncoder) {
+	b.mu.Lock()
+	b.metadata++
+	b.mu.Unlock()
+	var topics []string
+	d.array(func() { topics = append(topics, d.string()) })
+	host, port, _ := net.SplitHostPort(b.addr())
+	p, _ := strconv.Atoi(port)
+	e.int32(1)
+	e.int32(1) // node id
+	e.string(host)
+	e.int32(int32(p))
+	e.int16(-1) // rack
+	e.int32(1)  // controller id
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		if kerr, ok := b.topicErrs[topic]; ok {
+			e.int16(int16(kerr))
+			e.string(topic)
+			e.int8(0)
+			e.int32(0) // partitions
+			continue
+		}
+		e.int16(0)
+		e.string(topic)
+		e.int8(0)
+		e.int32(stubPartitions)
+		for i := int32(0); i < stubPartitions; i++ {
+			e.int16(0)
+			e.int32(i)
+			e.int32(1) // leader
+			e.int32(1) // replicas
+			e.int32(1)
+			e.int32(1) // isr
+			e.int32(1)
+		}
+	}
+}
+
+func (b *stubBroker) handleProduce(d *kafkaDecoder, e *kafkaEncoder, version int16) error {
+	_ = d.string() // transactional id
+	if acks := d.int16(); acks != -1 {
+		return fmt.Errorf("acks: got %d", acks)
+	}
+	_ = d.int32() // timeout
+	batches := make(map[topicPartition][]byte)
+	d.array(func() {
+		topic := d.string()
+		d.array(func() {
+			p := d.int32()
+			batches[topicPartition{topic, p}] = d.bytes()
+		})
+	})
+	if d.err != nil {
+		return d.err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.produces++
+	var kerr kafkaError
+	if len(b.errs) > 0 {
+		kerr, b.errs = b.errs[0], b.errs[1:]
+	}
+	e.int32(int32(len(batches)))
+	for tp, batch := range batches {
+		if kerr == 0 {
+			codec, msgs, err := decodeRecordBatch(batch)
+			if err != nil {
+				return err
+			}
+			b.codecs[codec] = true
+			b.msgs[tp] = append(b.msgs[tp], msgs...)
+		}
+		e.string(tp.topic)
+		e.int32(1)
+		e.int32(tp.partition)
+		e.int16(int16(kerr))
+		e.int64(0)  // base offset
+		e.int64(-1) // log append time
+		if version >= 5 {
+			e.int64(0)
+		}
+	}
+	e.int32(0) // throttle time
+	return nil
+}
+
+func decodeRecordBatch(b []byte) (codec int8, msgs []kafkaMessage, err error) {
+	d := &kafkaDecoder{b: b}
+	_ = d.int64() // base offset
+	if n := d.int32(); int(n) != len(d.b) {
+		return 0, nil, fmt.Errorf("batch length: got %d, want %d", n, len(d.b))
+	}
+	_ = d.int32() // leader epoch
+	if magic := d.int8(); magic != 2 {
+		return 0, nil, fmt.Errorf("magic: got %d", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.b, crc32c) {
+		return 0, nil, errors.New("crc mismatch")
+	}
+	codec = int8(d.int16() & 7)
+	_ = d.int32() // last offset delta
+	first := d.int64()
+	_ = d.int64() // max timestamp
+	_ = d.int64() // producer id
+	_ = d.int16() // producer epoch
+	_ = d.int32() // base sequence
+	count := d.int32()
+	if d.err != nil {
+		return 0, nil, d.err
+	}
+	data, err := decompress(codec, d.b)
+	if err != nil {
+		return 0, nil, err
+	}
+	d = &kafkaDecoder{b: data}
+	for i := int32(0); i < count; i++ {
+		rec := &kafkaDecoder{b: d.next(int(d.varint()))}
+		_ = rec.int8() // attributes
+		ts := first + rec.varint()
+		if delta := rec.varint(); delta != int64(i) {
+			return 0, nil, fmt.Errorf("offset delta: got %d, want %d", delta, i)
+		}
+		key := rec.next(int(rec.varint()))
+		value := rec.next(int(rec.varint()))
+		if headers := rec.varint(); headers != 0 {
+			return 0, nil, errors.New("headers not expected")
+		}
+		if rec.err != nil {
+			return 0, nil, rec.err
+		}
+		msgs = append(msgs, kafkaMessage{key: key, value: value, ts: ts})
+	}
+	if d.err != nil || len(d.b) != 0 {
+		return 0, nil, errors.New("invalid records")
+	}
+	return codec, msgs, nil
+}
+
+func decompress(codec int8, b []byte) ([]byte, error) {
+	switch codec {
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case codecSnappy:
+		if !bytes.HasPrefix(b, xerialHeader) {
+			return nil, errors.New("snappy: xerial header missing")
+		}
+		b = b[len(xerialHeader):]
+		var dst []byte
+		for len(b) > 0 {
+			n := binary.BigEndian.Uint32(b)
+			block, err := snappy.Decode(nil, b[4:4+n])
+			if err != nil {
+				return nil, err
+			}
+			dst = append(dst, block...)
+			b = b[4+n:]
+		}
+		return dst, nil
+	case codecLZ4:
+		return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(b)))
+	case codecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(b, nil)
+	}
+	return b, nil
+}
+
+// scramServer is server side of scram exchange
+type scramServer struct {
+	hash        func() hash.Hash
+	user        string
+	salted      []byte
+	state       int
+	clientFirst string
+	serverFirst string
+}
+
+func newScramServer(mechanism, user, pass string) *scramServer {
+	h := sha256.New
+	if mechanism == "SCRAM-SHA-512" {
+		h = sha512.New
+	}
+	return &scramServer{
+		hash:   h,
+		user:   user,
+		salted: pbkdf2(h, []byte(pass), []byte("saltysalt"), 4096),
+	}
+}
+
+func (s *scramServer) step(msg []byte) ([]byte, bool, error) {
+	s.state++
+	switch s.state {
+	case 1:
+		if !bytes.HasPrefix(msg, []byte("n,,")) {
+			return nil, false, errors.New("invalid gs2 header")
+		}
+		s.clientFirst = string(msg[3:])
+		attrs := scramAttrs(s.clientFirst)
+		if attrs["n"] != s.user {
+			return nil, false, errors.New("unknown user")
+		}
+		s.serverFirst = "r=" + attrs["r"] + "servernonce,s=" + base64.StdEncoding.EncodeToString([]byte("saltysalt")) + ",i=4096"
+		return []byte(s.serverFirst), false, nil
+	case 2:
+		clientFinal := string(msg)
+		i := strings.LastIndex(clientFinal, ",p=")
+		if i == -1 {
+			return nil, false, errors.New("proof missing")
+		}
+		proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+		if err != nil {
+			return nil, false, err
+		}
+		authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + clientFinal[:i])
+		h := s.hash()
+		h.Write(hmacSum(s.hash, s.salted, []byte("Client Key")))
+		storedKey := h.Sum(nil)
+		sig := hmacSum(s.hash, storedKey, authMessage)
+		if len(proof) != len(sig) {
+			return nil, false, errors.New("invalid proof")
+		}
+		for i := range proof {
+			proof[i] ^= sig[i]
+		}
+		h = s.hash()
+		h.Write(proof)
+		if !bytes.Equal(h.Sum(nil), storedKey) {
+			return nil, false, errors.New("invalid proof")
+		}
+		serverKey := hmacSum(s.hash, s.salted, []byte("Server Key"))
+		return []byte("v=" + base64.StdEncoding.EncodeToString(hmacSum(s.hash, serverKey, authMessage))), true, nil
+	}
+	return nil, false, errors.New("unexpected message")
+}
+
+func newKafkaRecord(ns, pod, msg string, ts time.Time) record {
+	rec := newLokiRecord(pod, msg, ts)
+	rec.k8s["namespace"] = ns
+	return rec
+}
+
+func TestKafkaOutput(t *testing.T) {
+	for name, codec := range kafkaCodecs {
+		t.Run(name, func(t *testing.T) {
+			broker := &stubBroker{}
+			broker.start(t)
+			o, err := parseKafkaConf(map[string]string{
+				"kafka.brokers":     broker.addr(),
+				"kafka.topic":       "logs-{namespace}",
+				"kafka.compression": name,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().Truncate(time.Millisecond)
+			for i := 0; i < 100; i++ {
+				ns := "prod"
+				if i%3 == 0 {
+					ns = "dev/x"
+				}
+				o.add(newKafkaRecord(ns, fmt.Sprint("web-", i%5), fmt.Sprint("message ", i), now.Add(time.Duration(i)*time.Millisecond)))
+			}
+			if cancelled := o.flush(); cancelled {
+				t.Fatal("must not be cancelled")
+			}
+			broker.mu.Lock()
+			defer broker.mu.Unlock()
+			if !broker.codecs[codec] || len(broker.codecs) != 1 {
+				t.Fatal("codecs: got", broker.codecs)
+			}
+			total, last := 0, make(map[string]int)
+			for tp, msgs := range broker.msgs {
+				if tp.topic != "logs-prod" && tp.topic != "logs-dev_x" {
+					t.Fatal("unexpected topic", tp.topic)
+				}
+				for _, msg := range msgs {
+					if p := partitionOf(msg.key, stubPartitions); p != tp.partition {
+						t.Fatalf("%s: got partition %d, want %d", msg.key, tp.partition, p)
+					}
+					doc, err := jsonUnmarshal(msg.value)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var i int
+					fmt.Sscanf(doc["@message"].(string), "message %d", &i)
+					if msg.ts != now.Add(time.Duration(i)*time.Millisecond).UnixNano()/int64(time.Millisecond) {
+						t.Fatal("timestamp mismatch for", doc["@message"])
+					}
+					key := tp.topic + "/" + string(msg.key)
+					if j, ok := last[key]; ok && j >= i {
+						t.Fatalf("%s: order not preserved", key)
+					}
+					last[key] = i
+					total++
+				}
+			}
+			if total != 100 {
+				t.Fatal("total: got", total)
+			}
+		})
+	}
+}
+
+func TestKafkaOutputErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      kafkaError
+		produces int
+		metadata int
+		received int
+	}{
+		{"retriable", 6, 2, 2, 10},    // NOT_LEADER_FOR_PARTITION
+		{"nonRetriable", 10, 1, 1, 0}, // MESSAGE_TOO_LARGE
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := &stubBroker{errs: []kafkaError{test.err}}
+			broker.start(t)
+			o, err := parseKafkaConf(map[string]string{"kafka.brokers": broker.addr()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				o.add(newKafkaRecord("prod", "web-1", fmt.Sprint("message ", i), time.Now()))
+			}
+			if cancelled := o.flush(); cancelled {
+				t.Fatal("must not be cancelled")
+			}
+			received := broker.received()
+			broker.mu.Lock()
+			defer broker.mu.Unlock()
+			if broker.produces != test.produces || broker.metadata != test.metadata || received != test.received {
+				t.Fatalf("got produces=%d metadata=%d received=%d", broker.produces, broker.metadata, received)
+			}
+			if len(o.(*kafkaOutput).msgs) != 0 {
+				t.Fatal("pending messages must be cleared")
+			}
+		})
+	}
+}
+
+func TestKafkaUnknownTopic(t *testing.T) {
+	broker := &stubBroker{topicErrs: map[string]kafkaError{"logs-dev": errUnknownTopic}}
+	broker.start(t)
+	o, err := parseKafkaConf(map[string]string{
+		"kafka.brokers": broker.addr(),
+		"kafka.topic":   "logs-{namespace}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ns := "prod"
+		if i%2 == 0 {
+			ns = "dev"
+		}
+		o.add(newKafkaRecord(ns, "web-1", fmt.Sprint("message ", i), time.Now()))
+	}
+	done := make(chan bool)
+	go func() { done <- o.flush() }()
+	select {
+	case cancelled := <-done:
+		if cancelled {
+			t.Fatal("must not be cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush must not retry records of unknown topic")
+	}
+	if n := broker.received(); n != 5 {
+		t.Fatal("received:", n)
+	}
+	if ko := o.(*kafkaOutput); len(ko.msgs) != 0 || ko.dropped != 5 {
+		t.Fatal("got pending", len(ko.msgs), "dropped", ko.dropped)
+	}
+}
+
+func TestKafkaSASL(t *testing.T) {
+	for _, mechanism := range []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		t.Run(mechanism, func(t *testing.T) {
+			broker := &stubBroker{mechanism: mechanism, user: "alice", pass: "secret,=pass"}
+			broker.start(t)
+			conf := map[string]string{
+				"kafka.brokers":        broker.addr(),
+				"kafka.sasl.mechanism": mechanism,
+				"kafka.sasl.username":  "alice",
+				"kafka.sasl.password":  "wrong",
+			}
+			o, err := parseKafkaConf(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := o.(*kafkaOutput).conn(broker.addr()); err == nil {
+				t.Fatal("authentication must fail with wrong password")
+			}
+
+			conf["kafka.sasl.password"] = broker.pass
+			if o, err = parseKafkaConf(conf); err != nil {
+				t.Fatal(err)
+			}
+			o.add(newKafkaRecord("prod", "web-1", "hello", time.Now()))
+			if cancelled := o.flush(); cancelled {
+				t.Fatal("must not be cancelled")
+			}
+			if n := broker.received(); n != 1 {
+				t.Fatal("received:", n)
+			}
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&sb, `{"@message":"GET /api/v1/users/%d","@level":"info"}`+"\n", i)
+	}
+	zenc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, codec := range kafkaCodecs {
+		for _, src := range [][]byte{[]byte("hello"), []byte(sb.String())} {
+			b, err := compress(codec, src, zenc)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if codec != codecNone && len(src) > 1000 && len(b) > len(src)/3 {
+				t.Errorf("%s: compressed size %d of %d", name, len(b), len(src))
+			}
+			got, err := decompress(codec, b)
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			if !bytes.Equal(got, src) {
+				t.Fatalf("%s: roundtrip failed for %d bytes", name, len(src))
+			}
+		}
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// test vectors from java client
+	tests := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for s, want := range tests {
+		if got := murmur2([]byte(s)); got != want {
+			t.Errorf("murmur2(%q): got %d, want %d", s, got, want)
+		}
+	}
+}
+
+func TestParseKafkaConfError(t *testing.T) {
+	for _, m := range []map[string]string{
+		{},
+		{"kafka.brokers": "kafka:9092", "kafka.topic": "logs-{namespace"},
+		{"kafka.brokers": "kafka:9092", "kafka.compression": "brotli"},
+		{"kafka.brokers": "kafka:9092", "kafka.batch_size": "-1"},
+		{"kafka.brokers": "kafka:9092", "kafka.sasl.mechanism": "GSSAPI"},
+		{"kafka.brokers": "kafka:9092", "kafka.tls": "true", "kafka.clientcert": "cert.pem"},
+	} {
+		if _, err := parseKafkaConf(m); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+}
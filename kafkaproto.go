@@ -0,0 +1,518 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// kafka wire protocol ---
+//
+// only the requests needed by producer are implemented.
+// see https://kafka.apache.org/protocol
+
+const (
+	apiProduce           int16 = 0
+	apiMetadata          int16 = 3
+	apiSaslHandshake     int16 = 17
+	apiSaslAuthenticate  int16 = 36
+	kafkaRequestTimeout        = 30 * time.Second
+	kafkaMetadataVersion int16 = 1
+)
+
+// compression codecs, as in record batch attributes
+const (
+	codecNone   int8 = 0
+	codecGzip   int8 = 1
+	codecSnappy int8 = 2
+	codecLZ4    int8 = 3
+	codecZstd   int8 = 4
+)
+
+var kafkaCodecs = map[string]int8{
+	"none":   codecNone,
+	"gzip":   codecGzip,
+	"snappy": codecSnappy,
+	"lz4":    codecLZ4,
+	"zstd":   codecZstd,
+}
+
+// kafkaError is error code returned by broker
+type kafkaError int16
+
+const (
+	errUnknownTopic       kafkaError = 3
+	errLeaderNotAvailable kafkaError = 5
+)
+
+var kafkaErrorNames = map[kafkaError]string{
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_FOR_PARTITION",
+	7:  "REQUEST_TIMED_OUT",
+	10: "MESSAGE_TOO_LARGE",
+	13: "NETWORK_EXCEPTION",
+	18: "RECORD_LIST_TOO_LARGE",
+	19: "NOT_ENOUGH_REPLICAS",
+	20: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	34: "ILLEGAL_SASL_STATE",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+	76: "UNSUPPORTED_COMPRESSION_TYPE",
+	87: "INVALID_RECORD",
+}
+
+func (e kafkaError) Error() string {
+	if name, ok := kafkaErrorNames[e]; ok {
+		return "kafka: " + name
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+// retriable tells whether produce should be retried.
+// records rejected with other errors are never accepted
+func (e kafkaError) retriable() bool {
+	switch e {
+	case 2, 10, 18, 76, 87:
+		return false
+	}
+	return true
+}
+
+// encoder ---
+
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *kafkaEncoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *kafkaEncoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+func (e *kafkaEncoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v) // zigzag encoded
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder ---
+
+var errShortResponse = errors.New("kafka: short response")
+
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errShortResponse
+		d.b = nil
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errShortResponse
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// string decodes string. null string is decoded as empty string
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n == -1 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n == -1 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// array calls f for each item of array
+func (d *kafkaDecoder) array(f func()) {
+	n := d.int32()
+	for i := int32(0); i < n && d.err == nil; i++ {
+		f()
+	}
+}
+
+// connection ---
+
+type kafkaConn struct {
+	net.Conn
+	clientID string
+	corrID   int32
+}
+
+// roundTrip sends request and returns decoder of response body
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body []byte) (*kafkaDecoder, error) {
+	c.corrID++
+	e := &kafkaEncoder{b: make([]byte, 0, 14+len(c.clientID)+len(body))}
+	e.int32(0) // size, filled later
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(c.corrID)
+	e.string(c.clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	if err := c.SetDeadline(time.Now().Add(kafkaRequestTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(e.b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: resp}
+	if corrID := d.int32(); corrID != c.corrID {
+		return nil, fmt.Errorf("kafka: correlation id mismatch: got %d, want %d", corrID, c.corrID)
+	}
+	return d, nil
+}
+
+// metadata ---
+
+type kafkaMetadata struct {
+	brokers    map[int32]string         // address by node id
+	partitions map[string]int           // number of partitions by topic
+	leaders    map[topicPartition]int32 // leader node id
+	errors     map[string]kafkaError    // by topic
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func encodeMetadataRequest(topics []string) []byte {
+	e := &kafkaEncoder{}
+	e.int32(int32(len(topics)))
+	for _, t := range topics {
+		e.string(t)
+	}
+	return e.b
+}
+
+func decodeMetadataResponse(d *kafkaDecoder) (*kafkaMetadata, error) {
+	md := &kafkaMetadata{
+		brokers:    make(map[int32]string),
+		partitions: make(map[string]int),
+		leaders:    make(map[topicPartition]int32),
+		errors:     make(map[string]kafkaError),
+	}
+	d.array(func() {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		_ = d.string() // rack
+		md.brokers[id] = net.JoinHostPort(host, fmt.Sprint(port))
+	})
+	_ = d.int32() // controller id
+	d.array(func() {
+		errCode := kafkaError(d.int16())
+		topic := d.string()
+		_ = d.int8() // is internal
+		n := 0
+		d.array(func() {
+			_ = d.int16() // error code
+			p := d.int32()
+			md.leaders[topicPartition{topic, p}] = d.int32()
+			d.array(func() { d.int32() }) // replicas
+			d.array(func() { d.int32() }) // isr
+			n++
+		})
+		if errCode != 0 {
+			md.errors[topic] = errCode
+		} else {
+			md.partitions[topic] = n
+		}
+	})
+	return md, d.err
+}
+
+// produce ---
+
+// produceVersion returns version of produce request to use.
+// zstd requires version 7 or above
+func produceVersion(codec int8) int16 {
+	if codec == codecZstd {
+		return 7
+	}
+	return 3
+}
+
+type kafkaMessage struct {
+	key   []byte
+	value []byte
+	ts    int64 // unix milliseconds
+}
+
+// encodeProduceRequest encodes produce request with acks=all.
+// batches is map of record batches to be produced
+func encodeProduceRequest(batches map[topicPartition][]byte) []byte {
+	byTopic := make(map[string][]topicPartition)
+	for tp := range batches {
+		byTopic[tp.topic] = append(byTopic[tp.topic], tp)
+	}
+	e := &kafkaEncoder{}
+	e.int16(-1) // transactional id
+	e.int16(-1) // acks=all
+	e.int32(int32(kafkaRequestTimeout / time.Millisecond))
+	e.int32(int32(len(byTopic)))
+	for topic, tps := range byTopic {
+		e.string(topic)
+		e.int32(int32(len(tps)))
+		for _, tp := range tps {
+			e.int32(tp.partition)
+			e.bytes(batches[tp])
+		}
+	}
+	return e.b
+}
+
+func decodeProduceResponse(d *kafkaDecoder, version int16) (map[topicPartition]kafkaError, error) {
+	result := make(map[topicPartition]kafkaError)
+	d.array(func() {
+		topic := d.string()
+		d.array(func() {
+			p := d.int32()
+			result[topicPartition{topic, p}] = kafkaError(d.int16())
+			_ = d.int64() // base offset
+			_ = d.int64() // log append time
+			if version >= 5 {
+				_ = d.int64() // log start offset
+			}
+		})
+	})
+	_ = d.int32() // throttle time
+	return result, d.err
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecordBatch encodes msgs as record batch of magic v2
+func encodeRecordBatch(msgs []kafkaMessage, codec int8, zenc *zstd.Encoder) ([]byte, error) {
+	first, max := msgs[0].ts, msgs[0].ts
+	for _, m := range msgs {
+		if m.ts < first {
+			first = m.ts
+		}
+		if m.ts > max {
+			max = m.ts
+		}
+	}
+	records := &kafkaEncoder{}
+	rec := &kafkaEncoder{}
+	for i, m := range msgs {
+		rec.b = rec.b[:0]
+		rec.int8(0) // attributes
+		rec.varint(m.ts - first)
+		rec.varint(int64(i))
+		rec.varint(int64(len(m.key)))
+		rec.b = append(rec.b, m.key...)
+		rec.varint(int64(len(m.value)))
+		rec.b = append(rec.b, m.value...)
+		rec.varint(0) // headers
+		records.varint(int64(len(rec.b)))
+		records.b = append(records.b, rec.b...)
+	}
+	data, err := compress(codec, records.b, zenc)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &kafkaEncoder{b: make([]byte, 0, 61+len(data))}
+	e.int64(0)  // base offset
+	e.int32(0)  // batch length, filled later
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // crc, filled later
+	e.int16(int16(codec))
+	e.int32(int32(len(msgs) - 1)) // last offset delta
+	e.int64(first)
+	e.int64(max)
+	e.int64(-1) // producer id
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(msgs)))
+	e.b = append(e.b, data...)
+	binary.BigEndian.PutUint32(e.b[8:], uint32(len(e.b)-12))
+	binary.BigEndian.PutUint32(e.b[17:], crc32.Checksum(e.b[21:], crc32c))
+	return e.b, nil
+}
+
+// xerialHeader is header of snappy framing used by kafka
+var xerialHeader = []byte{130, 'S', 'N', 'A', 'P', 'P', 'Y', 0, 0, 0, 0, 1, 0, 0, 0, 1}
+
+func compress(codec int8, b []byte, zenc *zstd.Encoder) ([]byte, error) {
+	switch codec {
+	case codecGzip:
+		buf := new(bytes.Buffer)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecSnappy:
+		const chunk = 32 * 1024
+		dst := append([]byte(nil), xerialHeader...)
+		for len(b) > 0 {
+			n := len(b)
+			if n > chunk {
+				n = chunk
+			}
+			block := snappy.Encode(nil, b[:n])
+			dst = binary.BigEndian.AppendUint32(dst, uint32(len(block)))
+			dst = append(dst, block...)
+			b = b[n:]
+		}
+		return dst, nil
+	case codecLZ4:
+		buf := new(bytes.Buffer)
+		w := lz4.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case codecZstd:
+		return zenc.EncodeAll(b, nil), nil
+	}
+	return b, nil
+}
+
+// murmur2 is the hash used by java client's default partitioner,
+// so that records with same key land on same partition
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	n := len(data)
+	h := seed ^ uint32(n)
+	for i := 0; i+4 <= n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[n&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+func partitionOf(key []byte, n int) int32 {
+	return (murmur2(key) & 0x7fffffff) % int32(n)
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+// levels in increasing order of severity
+var levels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// severity numbers as per opentelemetry log data model
+var severities = map[string]int{
+	"trace": 1,
+	"debug": 5,
+	"info":  9,
+	"warn":  13,
+	"error": 17,
+	"fatal": 21,
+}
+
+var levelAliases = map[string]string{
+	"trace": "trace", "trc": "trace", "t": "trace", "finest": "trace", "finer": "trace", "verbose": "trace",
+	"debug": "debug", "dbg": "debug", "d": "debug", "fine": "debug",
+	"info": "info", "inf": "info", "i": "info", "information": "info", "notice": "info",
+	"warn": "warn", "warning": "warn", "wrn": "warn", "w": "warn",
+	"error": "error", "err": "error", "e": "error", "severe": "error",
+	"fatal": "fatal", "ftl": "fatal", "f": "fatal", "panic": "fatal", "critical": "fatal", "crit": "fatal",
+	"emerg": "fatal", "emergency": "fatal", "alert": "fatal",
+}
+
+var levelKeys = []string{"level", "lvl", "severity", "loglevel", "log_level"}
+
+// normalizeLevel adds @level and @severity fields to rec,
+// derived from level field or klog prefix of @message
+func (a8n *annotation) normalizeLevel(rec map[string]interface{}) {
+	var level string
+	if a8n.levelKey != "" {
+		level = toLevel(lookupLevel(rec, a8n.levelKey))
+	} else {
+		fields := rec
+		if m, ok := rec[a8n.nestKey].(map[string]interface{}); ok && a8n.conflict == "nest" {
+			fields = m
+		}
+		for _, k := range levelKeys {
+			if level = toLevel(lookupLevel(fields, k)); level != "" {
+				break
+			}
+		}
+	}
+	if level == "" {
+		level = klogLevel(rec["@message"])
+	}
+	if level != "" {
+		rec["@level"] = level
+		rec["@severity"] = severities[level]
+	}
+}
+
+func lookupLevel(rec map[string]interface{}, key string) interface{} {
+	if v, ok := rec[key]; ok {
+		return v
+	}
+	return rec[key+"$num"]
+}
+
+// toLevel maps level names and pino/bunyan level numbers
+func toLevel(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return levelAliases[strings.ToLower(strings.TrimSpace(v))]
+	case float64:
+		if i := int(v); float64(i) == v && i%10 == 0 && i >= 10 && i <= 60 {
+			return levels[i/10-1]
+		}
+	case int64:
+		return toLevel(float64(v))
+	}
+	return ""
+}
+
+// klogLevel detects klog header such as "I0102 15:04:05.123456"
+func klogLevel(v interface{}) string {
+	msg, ok := v.(string)
+	if !ok || len(msg) < 6 || msg[5] != ' ' {
+		return ""
+	}
+	for i := 1; i < 5; i++ {
+		if msg[i] < '0' || msg[i] > '9' {
+			return ""
+		}
+	}
+	switch msg[0] {
+	case 'I':
+		return "info"
+	case 'W':
+		return "warn"
+	case 'E':
+		return "error"
+	case 'F':
+		return "fatal"
+	}
+	return ""
+}
@@ -124,6 +124,11 @@ func fetchMetadata(logName string) map[string]interface{} {
 	} else if s, ok := pod.Metadata.Annotations["logflow.io/parser"]; ok {
 		k8s["annotation"] = s
 	}
+	if s, ok := pod.Metadata.Annotations["logflow.io/index-"+cname]; ok {
+		k8s["index"] = s
+	} else if s, ok := pod.Metadata.Annotations["logflow.io/index"]; ok {
+		k8s["index"] = s
+	}
 	return k8s
 }
 
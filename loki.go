@@ -0,0 +1,351 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/santhosh-tekuri/json"
+)
+
+// lokiOutput sends records to grafana loki using push api.
+//
+// selected @k8s fields are used as stream labels, and rest
+// of the record is sent as json log line
+type lokiOutput struct {
+	url       string
+	format    string // protobuf or json
+	tenant    string
+	auth      string
+	labels    []k8sLabel
+	batchSize int
+	client    *http.Client
+
+	streams map[string]*lokiStream // by labels
+	size    int
+}
+
+type lokiStream struct {
+	labels  string
+	values  map[string]interface{} // labels as map, used in json format
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+func parseLokiConf(m map[string]string) (output, error) {
+	s, ok := m["loki.url"]
+	if !ok {
+		return nil, errors.New("config: loki.url missing")
+	}
+	o := &lokiOutput{
+		url:       strings.TrimSuffix(s, "/") + "/loki/api/v1/push",
+		format:    "protobuf",
+		tenant:    m["loki.tenant"],
+		batchSize: 1024 * 1024,
+		client:    &http.Client{Timeout: time.Minute},
+		streams:   make(map[string]*lokiStream),
+	}
+	if s, ok = m["loki.format"]; ok {
+		if s != "protobuf" && s != "json" {
+			return nil, errors.New("config: invalid loki.format " + s)
+		}
+		o.format = s
+	}
+	labels := "namespace,pod,container=container_name,app=labels.app"
+	if s, ok = m["loki.labels"]; ok {
+		labels = s
+	}
+	var err error
+	if o.labels, err = parseK8sLabels(labels); err != nil {
+		return nil, fmt.Errorf("config: invalid loki.labels: %v", err)
+	}
+	sort.Slice(o.labels, func(i, j int) bool {
+		return o.labels[i].name < o.labels[j].name
+	})
+	if s, ok = m["loki.basicAuth"]; ok {
+		if strings.IndexByte(s, ':') == -1 {
+			return nil, errors.New("config: loki.basicAuth has invalid value")
+		}
+		o.auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	if s, ok = m["loki.batch_size"]; ok {
+		kb, err := strconv.Atoi(s)
+		if err != nil || kb <= 0 {
+			return nil, errors.New("config: invalid loki.batch_size " + s)
+		}
+		o.batchSize = kb * 1024
+	}
+
+	// server cert is verified using system roots, unless loki.cacert is specified
+	_, cacert := m["loki.cacert"]
+	_, clientcert := m["loki.clientcert"]
+	if cacert || clientcert {
+		t := &tls.Config{}
+		if s, ok = m["loki.cacert"]; ok {
+			b, err := ioutil.ReadFile(s)
+			if err != nil {
+				return nil, err
+			}
+			t.RootCAs = x509.NewCertPool()
+			if !t.RootCAs.AppendCertsFromPEM(b) {
+				return nil, errors.New("config: no certificates in loki.cacert " + s)
+			}
+		}
+		if s, ok = m["loki.clientcert"]; ok {
+			key, ok := m["loki.clientkey"]
+			if !ok {
+				return nil, errors.New("config: loki.clientkey missing")
+			}
+			clientCert, err := tls.LoadX509KeyPair(s, key)
+			if err != nil {
+				return nil, err
+			}
+			t.Certificates = []tls.Certificate{clientCert}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = t
+		o.client.Transport = transport
+	}
+	return o, nil
+}
+
+func (o *lokiOutput) add(rec record) (full bool) {
+	// stream labels
+	var buf strings.Builder
+	values := make(map[string]interface{})
+	used := make(map[string]bool) // @k8s fields used as labels
+	buf.WriteByte('{')
+	for _, l := range o.labels {
+		v := l.value(rec.k8s)
+		if v == "" {
+			continue
+		}
+		if len(values) > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(l.name)
+		buf.WriteByte('=')
+		buf.WriteString(strconv.Quote(v))
+		values[l.name] = v
+		used[l.path] = true
+	}
+	if len(values) == 0 {
+		buf.WriteString(`job="logflow"`)
+		values["job"] = "logflow"
+	}
+	buf.WriteByte('}')
+	labels := buf.String()
+
+	// log line
+	doc := make(map[string]interface{}, len(rec.doc))
+	for k, v := range rec.doc {
+		doc[k] = v
+	}
+	k8s := rec.k8s
+	for path := range used {
+		k8s, _ = removeField(k8s, path)
+	}
+	doc["@k8s"] = k8s
+	b, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, rec.doc["@timestamp"].(string))
+	if err != nil {
+		ts = time.Now()
+	}
+
+	s, ok := o.streams[labels]
+	if !ok {
+		s = &lokiStream{labels: labels, values: values}
+		o.streams[labels] = s
+	}
+	s.entries = append(s.entries, lokiEntry{ts, string(b)})
+	o.size += len(b)
+	return o.size >= o.batchSize
+}
+
+// removeField returns copy of m without field, which is looked up
+// as in lookupField. objects along the path are copied, so that m
+// is not modified
+func removeField(m map[string]interface{}, field string) (map[string]interface{}, bool) {
+	if _, ok := m[field]; ok {
+		return copyWithout(m, field, nil), true
+	}
+	for i := 0; i < len(field); i++ {
+		if field[i] == '.' {
+			if sub, ok := m[field[:i]].(map[string]interface{}); ok {
+				if sub, ok := removeField(sub, field[i+1:]); ok {
+					return copyWithout(m, field[:i], sub), true
+				}
+			}
+		}
+	}
+	return m, false
+}
+
+// copyWithout returns copy of m, with k removed if v is nil, otherwise set to v
+func copyWithout(m map[string]interface{}, k string, v map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for ck, cv := range m {
+		c[ck] = cv
+	}
+	if v == nil {
+		delete(c, k)
+	} else {
+		c[k] = v
+	}
+	return c
+}
+
+func (o *lokiOutput) flush() (cancelled bool) {
+	if len(o.streams) == 0 {
+		return false
+	}
+
+	// loki rejects entries older than the last entry in a stream
+	for _, s := range o.streams {
+		sort.SliceStable(s.entries, func(i, j int) bool {
+			return s.entries[i].ts.Before(s.entries[j].ts)
+		})
+	}
+	var body []byte
+	contentType := "application/x-protobuf"
+	if o.format == "json" {
+		body = o.encodeJSON()
+		contentType = "application/json"
+	} else {
+		body = snappy.Encode(nil, o.encodeProto())
+	}
+	if cancelled := retry("loki", func() error { return o.push(body, contentType) }); cancelled {
+		return true
+	}
+	o.streams = make(map[string]*lokiStream)
+	o.size = 0
+	return false
+}
+
+// push sends body to loki. it returns error only if
+// request should be retried
+func (o *lokiOutput) push(body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(exitCtx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if o.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", o.tenant)
+	}
+	if o.auth != "" {
+		req.Header.Set("Authorization", o.auth)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok && uerr.Err == context.Canceled {
+			return uerr.Err
+		}
+		return err
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("loki returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	// entries which are out of order or too old are rejected by loki,
+	// while the rest are accepted. retrying does not help in such cases
+	warn("loki returned", resp.Status, ":", string(bytes.TrimSpace(msg)))
+	return nil
+}
+
+func (o *lokiOutput) encodeJSON() []byte {
+	streams := make([]interface{}, 0, len(o.streams))
+	for _, s := range o.streams {
+		values := make([]interface{}, len(s.entries))
+		for i, e := range s.entries {
+			values[i] = []interface{}{strconv.FormatInt(e.ts.UnixNano(), 10), e.line}
+		}
+		streams = append(streams, map[string]interface{}{
+			"stream": s.values,
+			"values": values,
+		})
+	}
+	b, err := json.Marshal(map[string]interface{}{"streams": streams})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// encodeProto encodes streams as logproto.PushRequest:
+//
+//	message PushRequest { repeated Stream streams = 1; }
+//	message Stream { string labels = 1; repeated Entry entries = 2; }
+//	message Entry { Timestamp timestamp = 1; string line = 2; }
+//	message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+func (o *lokiOutput) encodeProto() []byte {
+	var req, stream, entry, ts []byte
+	for _, s := range o.streams {
+		stream = appendProtoBytes(stream[:0], 1, []byte(s.labels))
+		for _, e := range s.entries {
+			ts = appendProtoVarint(ts[:0], 1, uint64(e.ts.Unix()))
+			ts = appendProtoVarint(ts, 2, uint64(e.ts.Nanosecond()))
+			entry = appendProtoBytes(entry[:0], 1, ts)
+			entry = appendProtoBytes(entry, 2, []byte(e.line))
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+	return req
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendVarint(b, uint64(field)<<3)
+	return appendVarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(b, uint64(field)<<3|2)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
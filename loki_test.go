@@ -0,0 +1,271 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/santhosh-tekuri/json"
+)
+
+// fakeLoki records pushed streams as labels => lines.
+// it responds with given status codes before accepting pushes
+type fakeLoki struct {
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	tenant   string
+	streams  map[string][]string
+}
+
+func (l *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests++
+	if len(l.statuses) > 0 {
+		status := l.statuses[0]
+		l.statuses = l.statuses[1:]
+		http.Error(w, "entry out of order", status)
+		return
+	}
+	if r.URL.Path != "/loki/api/v1/push" {
+		http.NotFound(w, r)
+		return
+	}
+	l.tenant = r.Header.Get("X-Scope-OrgID")
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Type") == "application/json" {
+		m, err := jsonUnmarshal(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, s := range m["streams"].([]interface{}) {
+			s := s.(map[string]interface{})
+			var labels []string
+			for k, v := range s["stream"].(map[string]interface{}) {
+				labels = append(labels, k+"="+`"`+v.(string)+`"`)
+			}
+			sort.Strings(labels)
+			key := "{" + strings.Join(labels, ", ") + "}"
+			for _, v := range s["values"].([]interface{}) {
+				l.streams[key] = append(l.streams[key], v.([]interface{})[1].(string))
+			}
+		}
+		return
+	}
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, stream := range protoFields(b, 1) {
+		labels := string(protoFields(stream, 1)[0])
+		for _, entry := range protoFields(stream, 2) {
+			l.streams[labels] = append(l.streams[labels], string(protoFields(entry, 2)[0]))
+		}
+	}
+}
+
+// protoFields returns values of length delimited field in b
+func protoFields(b []byte, field uint64) [][]byte {
+	var values [][]byte
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			b = b[n:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			b = b[n:]
+			if tag>>3 == field {
+				values = append(values, b[:size])
+			}
+			b = b[size:]
+		}
+	}
+	return values
+}
+
+func newLokiRecord(pod, msg string, ts time.Time) record {
+	return record{
+		k8s: map[string]interface{}{
+			"namespace":      "prod",
+			"pod":            pod,
+			"container_name": "web",
+			"nodename":       "node1",
+			"labels":         map[string]interface{}{"app": "shop"},
+		},
+		doc: map[string]interface{}{
+			"@message":   msg,
+			"@timestamp": ts.Format(time.RFC3339Nano),
+			"@k8s":       json.RawMessage("{}"),
+		},
+	}
+}
+
+func TestLokiOutput(t *testing.T) {
+	for _, format := range []string{"protobuf", "json"} {
+		t.Run(format, func(t *testing.T) {
+			fake := &fakeLoki{streams: make(map[string][]string), statuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			o, err := parseLokiConf(map[string]string{"loki.url": srv.URL, "loki.format": format, "loki.tenant": "team-a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			o.add(newLokiRecord("web-1", "second", now.Add(time.Second)))
+			o.add(newLokiRecord("web-2", "other", now))
+			o.add(newLokiRecord("web-1", "first", now))
+			if cancelled := o.flush(); cancelled {
+				t.Fatal("must not be cancelled")
+			}
+			if fake.requests != 3 {
+				t.Fatal("must retry on 429 and 5xx, requests:", fake.requests)
+			}
+			if fake.tenant != "team-a" {
+				t.Fatal("tenant: got", fake.tenant)
+			}
+			lines := fake.streams[`{app="shop", container="web", namespace="prod", pod="web-1"}`]
+			if len(lines) != 2 || len(fake.streams) != 2 {
+				t.Fatalf("got %v", fake.streams)
+			}
+			line, err := jsonUnmarshal([]byte(lines[0]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line["@message"] != "first" {
+				t.Fatal("entries must be sorted by timestamp, got", lines)
+			}
+			want := map[string]interface{}{
+				"nodename": "node1",
+				"labels":   map[string]interface{}{},
+			}
+			if !reflect.DeepEqual(line["@k8s"], want) {
+				t.Fatal("@k8s: got", line["@k8s"])
+			}
+		})
+	}
+}
+
+func TestLokiOutputRejected(t *testing.T) {
+	fake := &fakeLoki{streams: make(map[string][]string), statuses: []int{http.StatusBadRequest}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	o, err := parseLokiConf(map[string]string{"loki.url": srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.add(newLokiRecord("web-1", "old", time.Now()))
+	if cancelled := o.flush(); cancelled {
+		t.Fatal("must not be cancelled")
+	}
+	if fake.requests != 1 {
+		t.Fatal("rejected entries must not be retried, requests:", fake.requests)
+	}
+	o.add(newLokiRecord("web-1", "new", time.Now()))
+	o.flush()
+	if lines := fake.streams[`{app="shop", container="web", namespace="prod", pod="web-1"}`]; len(lines) != 1 {
+		t.Fatal("batch must be cleared after rejection, got", lines)
+	}
+}
+
+func TestParseLokiConfError(t *testing.T) {
+	for _, m := range []map[string]string{
+		{},
+		{"loki.url": "http://loki:3100", "loki.format": "xml"},
+		{"loki.url": "http://loki:3100", "loki.labels": "a-b=pod"},
+		{"loki.url": "http://loki:3100", "loki.basicAuth": "user"},
+		{"loki.url": "http://loki:3100", "loki.batch_size": "0"},
+		{"loki.url": "http://loki:3100", "loki.clientcert": "client.crt"},
+		{"loki.url": "http://loki:3100", "loki.cacert": "missing.crt"},
+	} {
+		if _, err := parseLokiConf(m); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+}
+
+func TestLokiNestedLabel(t *testing.T) {
+	o, err := parseLokiConf(map[string]string{"loki.url": "http://loki:3100", "loki.labels": "team=labels.team"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newLokiRecord("web-1", "hello", time.Now())
+	rec.k8s["labels"] = map[string]interface{}{"app": "shop", "team": "payments"}
+	o.add(rec)
+	lo := o.(*lokiOutput)
+	s := lo.streams[`{team="payments"}`]
+	if s == nil {
+		t.Fatal("got streams", lo.streams)
+	}
+	line, err := jsonUnmarshal([]byte(s.entries[0].line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"app": "shop"}
+	if got := line["@k8s"].(map[string]interface{})["labels"]; !reflect.DeepEqual(got, want) {
+		t.Fatal("labels in line: got", got)
+	}
+	if got := rec.k8s["labels"].(map[string]interface{})["team"]; got != "payments" {
+		t.Fatal("record must not be modified, got", rec.k8s)
+	}
+}
+
+func TestLokiCACert(t *testing.T) {
+	fake := &fakeLoki{streams: make(map[string][]string)}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+	cacert := filepath.Join(t.TempDir(), "ca.crt")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(cacert, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	o, err := parseLokiConf(map[string]string{"loki.url": srv.URL, "loki.cacert": cacert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.add(newLokiRecord("web-1", "hello", time.Now()))
+	if err := o.(*lokiOutput).push(snappy.Encode(nil, o.(*lokiOutput).encodeProto()), "application/x-protobuf"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.streams) != 1 {
+		t.Fatal("got", fake.streams)
+	}
+
+	// without cacert, server cert is not trusted
+	o, err = parseLokiConf(map[string]string{"loki.url": srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.(*lokiOutput).push(nil, "application/x-protobuf"); err == nil {
+		t.Fatal("error expected for untrusted server cert")
+	}
+}
@@ -47,12 +47,21 @@ func main() {
 
 	var wg sync.WaitGroup
 
+	if quotaEnabled() {
+		quota.load()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			quota.persist()
+		}()
+	}
+
 	r := newRecords()
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer info("exporter exited")
-		export(r)
+		export(r, outputs)
 	}()
 
 	wg.Add(1)
@@ -61,6 +70,14 @@ func main() {
 		watchContainers(r.records)
 	}()
 
+	if metricsAddr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveMetrics()
+		}()
+	}
+
 	var cancel context.CancelFunc
 	exitCtx, cancel = context.WithCancel(context.Background())
 	ch := make(chan os.Signal, 2)
@@ -95,5 +112,32 @@ func parseConf(path string) error {
 			return err
 		}
 	}
+	if err := parseTypeConflict(m, "json.", &typeConflict, &maxDepth, &nestKey); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if globalFilter, err = parseFilter(m, "filter."); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := parseRateLimitConf(m); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := parseQuotaConf(m); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := parseRedactConf(m); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if globalTransforms, err = parseTransformConf(m, "transform."); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if globalRules, err = parseRules(m, "rule."); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := parseDedup(m, "dedup.", &defaultDedup); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
+	if err := parseMetricsConf(m); err != nil {
+		return fmt.Errorf("config: %v", err)
+	}
 	return parseExportConf(m)
 }
@@ -0,0 +1,336 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// options
+var (
+	metricsAddr   = "" // empty means /metrics endpoint is disabled
+	metricsExpire = time.Hour
+	logMetrics    []*logMetric
+	metricsMu     sync.Mutex // guards series of logMetrics
+	prunedAt      time.Time  // when idle series are last removed
+)
+
+// logMetric is a prometheus counter or histogram
+// derived from log records
+type logMetric struct {
+	name    string
+	typ     string // counter or histogram
+	help    string
+	match   node // nil matches all records
+	value   node // observed value for histogram
+	labels  []k8sLabel
+	buckets []float64
+	series  map[string]*series
+}
+
+// k8sLabel is a label whose value is taken from @k8s
+type k8sLabel struct {
+	name string
+	path string
+}
+
+// parseK8sLabels parses comma separated labels of form name=path
+// or path, for example: namespace,app=labels.app
+func parseK8sLabels(s string) ([]k8sLabel, error) {
+	var labels []k8sLabel
+	for _, l := range strings.Split(s, ",") {
+		l = strings.TrimSpace(l)
+		kl := k8sLabel{name: l, path: l}
+		if eq := strings.IndexByte(l, '='); eq != -1 {
+			kl.name, kl.path = strings.TrimSpace(l[:eq]), strings.TrimSpace(l[eq+1:])
+		} else {
+			kl.name = strings.NewReplacer(".", "_", "-", "_", "/", "_").Replace(l)
+		}
+		if !reMetricName.MatchString(kl.name) || kl.path == "" {
+			return nil, errors.New("invalid label " + l)
+		}
+		labels = append(labels, kl)
+	}
+	return labels, nil
+}
+
+func (l k8sLabel) value(k8s map[string]interface{}) string {
+	if v, ok := lookupField(k8s, l.path); ok {
+		return sprint(v)
+	}
+	return ""
+}
+
+type series struct {
+	labels  []string
+	count   float64 // value for counter
+	sum     float64
+	buckets []float64 // cumulative counts
+	updated time.Time
+}
+
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var reMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// parseMetricsConf parses metrics.listen and metric.NAME.* options
+func parseMetricsConf(m map[string]string) error {
+	if s, ok := m["metrics.listen"]; ok {
+		metricsAddr = s
+	}
+	metricsExpire = time.Hour
+	if s, ok := m["metrics.expire"]; ok {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			return errors.New("invalid metrics.expire " + s)
+		}
+		metricsExpire = d
+	}
+	names := make(map[string]bool)
+	for k := range m {
+		if strings.HasPrefix(k, "metric.") {
+			if dot := strings.LastIndexByte(k, '.'); dot > len("metric.") {
+				names[k[len("metric."):dot]] = true
+			}
+		}
+	}
+	logMetrics = nil
+	for name := range names {
+		lm, err := parseMetric(m, name)
+		if err != nil {
+			return err
+		}
+		logMetrics = append(logMetrics, lm)
+	}
+	sort.Slice(logMetrics, func(i, j int) bool {
+		return logMetrics[i].name < logMetrics[j].name
+	})
+	if len(logMetrics) > 0 && metricsAddr == "" {
+		return errors.New("metrics.listen missing")
+	}
+	return nil
+}
+
+func parseMetric(m map[string]string, name string) (*logMetric, error) {
+	prefix := "metric." + name + "."
+	if !reMetricName.MatchString(name) {
+		return nil, errors.New("invalid metric name " + name)
+	}
+	lm := &logMetric{
+		name:   name,
+		typ:    m[prefix+"type"],
+		help:   m[prefix+"help"],
+		series: make(map[string]*series),
+	}
+	if lm.help == "" {
+		lm.help = "logflow " + lm.typ + " derived from log records"
+	}
+	var err error
+	if s, ok := m[prefix+"match"]; ok {
+		if lm.match, err = compileExpr(s); err != nil {
+			return nil, errors.New("invalid " + prefix + "match: " + err.Error())
+		}
+	}
+	switch lm.typ {
+	case "counter":
+	case "histogram":
+		s, ok := m[prefix+"value"]
+		if !ok {
+			return nil, errors.New(prefix + "value missing")
+		}
+		if lm.value, err = compileExpr(s); err != nil {
+			return nil, errors.New("invalid " + prefix + "value: " + err.Error())
+		}
+		lm.buckets = defaultBuckets
+		if s, ok := m[prefix+"buckets"]; ok {
+			lm.buckets = nil
+			for _, b := range strings.Split(s, ",") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+				if err != nil || (len(lm.buckets) > 0 && f <= lm.buckets[len(lm.buckets)-1]) {
+					return nil, errors.New("invalid " + prefix + "buckets " + s)
+				}
+				lm.buckets = append(lm.buckets, f)
+			}
+		}
+	default:
+		return nil, errors.New("invalid " + prefix + "type " + lm.typ)
+	}
+
+	if s := m[prefix+"labels"]; s != "" {
+		if lm.labels, err = parseK8sLabels(s); err != nil {
+			return nil, errors.New("invalid " + prefix + "labels: " + err.Error())
+		}
+	}
+	return lm, nil
+}
+
+// observeMetrics updates logMetrics matching rec
+func observeMetrics(rec record) {
+	if len(logMetrics) == 0 {
+		return
+	}
+	env := &exprEnv{rec: rec.doc, k8s: rec.k8s}
+	now := time.Now()
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if metricsExpire > 0 && now.Sub(prunedAt) >= time.Minute {
+		prunedAt = now
+		pruneMetrics(now.Add(-metricsExpire))
+	}
+	for _, lm := range logMetrics {
+		if lm.match != nil && !evalBool(lm.match, env) {
+			continue
+		}
+		var v float64
+		if lm.typ == "histogram" {
+			f, ok := toNumber(lm.value.eval(env))
+			if !ok {
+				continue
+			}
+			v = f
+		}
+		lm.observe(rec.k8s, v, now)
+	}
+}
+
+// pruneMetrics removes series not updated since given time, so that
+// series of deleted pods do not accumulate
+func pruneMetrics(since time.Time) {
+	for _, lm := range logMetrics {
+		for k, s := range lm.series {
+			if s.updated.Before(since) {
+				delete(lm.series, k)
+			}
+		}
+	}
+}
+
+func (lm *logMetric) observe(k8s map[string]interface{}, v float64, now time.Time) {
+	labels := make([]string, len(lm.labels))
+	for i, l := range lm.labels {
+		labels[i] = l.value(k8s)
+	}
+	key := strings.Join(labels, "\x00")
+	s, ok := lm.series[key]
+	if !ok {
+		s = &series{labels: labels, buckets: make([]float64, len(lm.buckets))}
+		lm.series[key] = s
+	}
+	s.count++
+	s.updated = now
+	if lm.typ == "histogram" {
+		s.sum += v
+		for i, b := range lm.buckets {
+			if v <= b {
+				s.buckets[i]++
+			}
+		}
+	}
+}
+
+// writeMetrics writes logMetrics in prometheus text format.
+// metrics are rendered into buffer with lock held, and written
+// after releasing it, so that slow scraper does not block export
+func writeMetrics(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	metricsMu.Lock()
+	renderMetrics(buf)
+	metricsMu.Unlock()
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// renderMetrics writes logMetrics to bw.
+// must be called with metricsMu held
+func renderMetrics(bw *bytes.Buffer) {
+	for _, lm := range logMetrics {
+		bw.WriteString("# HELP " + lm.name + " " + lm.help + "\n")
+		bw.WriteString("# TYPE " + lm.name + " " + lm.typ + "\n")
+		keys := make([]string, 0, len(lm.series))
+		for k := range lm.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := lm.series[k]
+			if lm.typ == "counter" {
+				lm.writeSample(bw, "", s, "", s.count)
+				continue
+			}
+			for i, b := range lm.buckets {
+				lm.writeSample(bw, "_bucket", s, formatFloat(b), s.buckets[i])
+			}
+			lm.writeSample(bw, "_bucket", s, "+Inf", s.count)
+			lm.writeSample(bw, "_sum", s, "", s.sum)
+			lm.writeSample(bw, "_count", s, "", s.count)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (lm *logMetric) writeSample(w *bytes.Buffer, suffix string, s *series, le string, v float64) {
+	w.WriteString(lm.name + suffix)
+	if len(lm.labels) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, l := range lm.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l.name + `="` + labelEscaper.Replace(s.labels[i]) + `"`)
+		}
+		if le != "" {
+			if len(lm.labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(`le="` + le + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serveMetrics serves /metrics endpoint on metricsAddr
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = writeMetrics(w)
+	})
+	srv := &http.Server{Addr: metricsAddr, Handler: mux}
+	go func() {
+		<-exitCh
+		_ = srv.Close()
+	}()
+	info("serving metrics on", metricsAddr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		warn("metrics server:", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	defer func() { logMetrics, metricsAddr, metricsExpire = nil, "", time.Hour }()
+	err := parseMetricsConf(map[string]string{
+		"metrics.listen":                    ":9100",
+		"metric.errors_total.type":          "counter",
+		"metric.errors_total.match":         `@level == "error"`,
+		"metric.errors_total.labels":        "namespace,app=labels.app",
+		"metric.request_seconds.type":       "histogram",
+		"metric.request_seconds.help":       "nginx request time",
+		"metric.request_seconds.value":      "request_time",
+		"metric.request_seconds.buckets":    "0.1, 1",
+		"metric.request_seconds.labels":     "namespace",
+		"metric.request_seconds.match":      `@k8s.labels.app == "nginx"`,
+		"metric.request_seconds.unknownopt": "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := map[string]interface{}{"namespace": "prod", "labels": map[string]interface{}{"app": `w"eb`}}
+	nginx := map[string]interface{}{"namespace": "prod", "labels": map[string]interface{}{"app": "nginx"}}
+	for _, rec := range []record{
+		{k8s: web, doc: map[string]interface{}{"@level": "error"}},
+		{k8s: web, doc: map[string]interface{}{"@level": "error"}},
+		{k8s: web, doc: map[string]interface{}{"@level": "info"}},
+		{k8s: nginx, doc: map[string]interface{}{"@level": "error", "request_time": 0.05}},
+		{k8s: nginx, doc: map[string]interface{}{"@level": "info", "request_time": float64(2)}},
+		{k8s: nginx, doc: map[string]interface{}{"@level": "info", "request_time": "bad"}},
+	} {
+		observeMetrics(rec)
+	}
+	buf := new(bytes.Buffer)
+	if err := writeMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP errors_total logflow counter derived from log records
+# TYPE errors_total counter
+errors_total{namespace="prod",app="nginx"} 1
+errors_total{namespace="prod",app="w\"eb"} 2
+# HELP request_seconds nginx request time
+# TYPE request_seconds histogram
+request_seconds_bucket{namespace="prod",le="0.1"} 1
+request_seconds_bucket{namespace="prod",le="1"} 1
+request_seconds_bucket{namespace="prod",le="+Inf"} 2
+request_seconds_sum{namespace="prod"} 2.05
+request_seconds_count{namespace="prod"} 2
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// idle series are removed
+	for _, s := range logMetrics[0].series {
+		if s.labels[1] == "nginx" {
+			s.updated = time.Now().Add(-2 * time.Hour)
+		}
+	}
+	prunedAt = time.Time{}
+	observeMetrics(record{k8s: web, doc: map[string]interface{}{"@level": "error"}})
+	buf.Reset()
+	if err := writeMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); strings.Contains(got, `app="nginx"`) || !strings.Contains(got, `app="w\"eb"} 3`) {
+		t.Fatalf("got:\n%s", got)
+	}
+}
+
+// blockingWriter blocks writes until unblock is closed
+type blockingWriter struct {
+	unblock chan struct{}
+}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return len(b), nil
+}
+
+func TestMetricsSlowScraper(t *testing.T) {
+	defer func() { logMetrics, metricsAddr = nil, "" }()
+	err := parseMetricsConf(map[string]string{
+		"metrics.listen":             ":9100",
+		"metric.errors_total.type":   "counter",
+		"metric.errors_total.labels": "namespace",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := record{k8s: map[string]interface{}{"namespace": "prod"}, doc: map[string]interface{}{}}
+	observeMetrics(rec)
+
+	w := blockingWriter{make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		_ = writeMetrics(w)
+		close(done)
+	}()
+	observed := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond) // let writeMetrics block in Write
+		observeMetrics(rec)
+		close(observed)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("observeMetrics blocked by slow scraper")
+	}
+	close(w.unblock)
+	<-done
+}
+
+func TestParseMetricsConfError(t *testing.T) {
+	defer func() { logMetrics, metricsAddr = nil, "" }()
+	tests := []map[string]string{
+		{"metric.x.type": "counter"},
+		{"metrics.listen": ":9100", "metric.x.type": "gauge"},
+		{"metrics.listen": ":9100", "metric.x-y.type": "counter"},
+		{"metrics.listen": ":9100", "metric.x.type": "counter", "metric.x.match": "a =="},
+		{"metrics.listen": ":9100", "metric.x.type": "histogram"},
+		{"metrics.listen": ":9100", "metric.x.type": "histogram", "metric.x.value": "v", "metric.x.buckets": "1,0.5"},
+		{"metrics.listen": ":9100", "metric.x.type": "counter", "metric.x.labels": "a-b=namespace"},
+		{"metrics.listen": ":9100", "metrics.expire": "1"},
+	}
+	for _, m := range tests {
+		if err := parseMetricsConf(m); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// options
+var (
+	outputs        []output
+	outputQueueLen = 10000 // max records buffered per output
+)
+
+// output ships records to a destination.
+//
+// each output is used from its own goroutine, and
+// records are added to it in the order they are read
+type output interface {
+	// add adds rec to current batch. it tells whether batch is full
+	add(rec record) (full bool)
+
+	// flush sends current batch, retrying until it succeeds.
+	// it returns true if cancelled by exit signal
+	flush() (cancelled bool)
+}
+
+var outputParsers = map[string]func(m map[string]string) (output, error){
+	"elasticsearch": parseESConf,
+	"file":          parseFileConf,
+	"loki":          parseLokiConf,
+	"kafka":         parseKafkaConf,
+}
+
+// parseExportConf parses outputs=NAME1,NAME2 and options of each output
+func parseExportConf(m map[string]string) error {
+	names := "elasticsearch"
+	if s, ok := m["outputs"]; ok {
+		names = s
+	}
+	if s, ok := m["outputs.queue_size"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return errors.New("config: invalid outputs.queue_size " + s)
+		}
+		outputQueueLen = n
+	}
+	outputs = nil
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		parse, ok := outputParsers[name]
+		if !ok {
+			return errors.New("config: unknown output " + name)
+		}
+		o, err := parse(m)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, o)
+	}
+	return nil
+}
+
+// flushInterval is the idle time after which partial batch is flushed
+const flushInterval = 500 * time.Millisecond
+
+type seqRecord struct {
+	seq uint64
+	rec record
+}
+
+type outputAck struct {
+	id  int
+	seq uint64
+}
+
+// export reads records and sends them to all outputs.
+//
+// records are numbered in the order they are read. each output
+// acknowledges the number of last record it flushed, and cursors
+// are moved only upto the record acknowledged by all outputs.
+//
+// each output has its own queue, so that an output which is down
+// does not stop others. when queue is full, records are dropped
+// for that output
+func export(r *records, outputs []output) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ins := make([]chan seqRecord, len(outputs))
+	acks := make(chan outputAck, len(outputs))
+	acked := make([]uint64, len(outputs))
+	for i, o := range outputs {
+		ins[i] = make(chan seqRecord)
+		queued := make(chan seqRecord)
+		wg.Add(2)
+		go func(o output, in <-chan seqRecord) {
+			defer wg.Done()
+			queueOutput(outputName(o), in, queued)
+		}(o, ins[i])
+		go func(id int, o output) {
+			defer wg.Done()
+			runOutput(id, o, queued, acks)
+		}(i, o)
+	}
+
+	onAck := func(a outputAck) {
+		acked[a.id] = a.seq
+		min := a.seq
+		for _, seq := range acked {
+			if seq < min {
+				min = seq
+			}
+		}
+		r.ack(min)
+		r.commit()
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	seq := uint64(0)
+	for {
+		select {
+		case <-exitCh:
+			return
+		case a := <-acks:
+			onAck(a)
+		case <-ticker.C:
+			r.commit()
+		case rec := <-r.records:
+			if rec.ext == -1 || rec.doc == nil {
+				r.mark(rec, seq)
+				continue
+			}
+			seq++
+			r.mark(rec, seq)
+			observeMetrics(rec)
+			if quotaEnabled() {
+				quota.add(rec.ns, recordSize(rec))
+			}
+			for _, in := range ins {
+			send:
+				for {
+					select {
+					case <-exitCh:
+						return
+					case a := <-acks:
+						onAck(a)
+					case in <- seqRecord{seq, rec}:
+						break send
+					}
+				}
+			}
+		}
+	}
+}
+
+// queueOutput buffers records from in, until out accepts them.
+// it holds at most outputQueueLen records, excess records are dropped
+func queueOutput(name string, in <-chan seqRecord, out chan<- seqRecord) {
+	var queue []seqRecord
+	dropped := 0
+	for {
+		var next chan<- seqRecord
+		var head seqRecord
+		if len(queue) > 0 {
+			next, head = out, queue[0]
+		}
+		select {
+		case <-exitCh:
+			return
+		case sr := <-in:
+			if len(queue) >= outputQueueLen {
+				if dropped == 0 {
+					warn(name, "output queue is full, dropping records")
+				}
+				dropped++
+				continue
+			}
+			queue = append(queue, sr)
+		case next <- head:
+			queue[0] = seqRecord{}
+			queue = queue[1:]
+			if len(queue) == 0 {
+				queue = nil
+				if dropped > 0 {
+					warn(name, "output dropped", dropped, "records")
+					dropped = 0
+				}
+			}
+		}
+	}
+}
+
+// outputName returns name of output o, for logging
+func outputName(o output) string {
+	switch o.(type) {
+	case *esOutput:
+		return "elasticsearch"
+	case *fileOutput:
+		return "file"
+	case *lokiOutput:
+		return "loki"
+	case *kafkaOutput:
+		return "kafka"
+	}
+	return "custom"
+}
+
+// runOutput adds records from in to o, and flushes it when
+// batch is full or no records are received for flushInterval
+func runOutput(id int, o output, in <-chan seqRecord, acks chan<- outputAck) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var last uint64  // seq of last record added
+	pending := false // whether batch has records not flushed
+	flush := func() (cancelled bool) {
+		if cancelled := o.flush(); cancelled {
+			return true
+		}
+		pending = false
+		select {
+		case <-exitCh:
+			return true
+		case acks <- outputAck{id, last}:
+			return false
+		}
+	}
+	for {
+		select {
+		case <-exitCh:
+			return
+		case sr := <-in:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			last, pending = sr.seq, true
+			if full := o.add(sr.rec); full {
+				if cancelled := flush(); cancelled {
+					return
+				}
+			} else {
+				timer.Reset(flushInterval)
+			}
+		case <-timer.C:
+			if pending {
+				if cancelled := flush(); cancelled {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOutput struct {
+	batch   []record
+	release chan struct{} // flush waits for it, if not nil
+	flushed chan []record
+}
+
+func (o *testOutput) add(rec record) bool {
+	o.batch = append(o.batch, rec)
+	return false
+}
+
+func (o *testOutput) flush() bool {
+	if o.release != nil {
+		select {
+		case <-o.release:
+		case <-exitCh:
+			return true
+		}
+	}
+	o.flushed <- o.batch
+	o.batch = nil
+	return false
+}
+
+func TestExportCommit(t *testing.T) {
+	saved := exitCh
+	exitCh = make(chan struct{})
+	defer func() { exitCh = saved }()
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+	committed := func() (int, int64) {
+		b, _ := ioutil.ReadFile(filepath.Join(dir, ".pos"))
+		cur := &cursor{b: b}
+		if len(b) != 16 {
+			return 0, 0
+		}
+		return cur.committed()
+	}
+
+	fast := &testOutput{flushed: make(chan []record, 10)}
+	slow := &testOutput{flushed: make(chan []record, 10), release: make(chan struct{})}
+	r := newRecords()
+	done := make(chan struct{})
+	go func() {
+		export(r, []output{fast, slow})
+		close(done)
+	}()
+	doc := map[string]interface{}{"@message": "hello"}
+	r.records <- record{dir: dir, ext: 0, pos: 10, doc: doc}
+	r.records <- record{dir: dir, ext: 0, pos: 20, doc: doc}
+	r.records <- record{dir: dir, ext: 1, pos: 5} // position only
+
+	if batch := <-fast.flushed; len(batch) != 2 {
+		t.Fatal("fast output: got", len(batch))
+	}
+	time.Sleep(2 * flushInterval)
+	if ext, pos := committed(); ext != 0 || pos != 0 {
+		t.Fatal("must not commit before slow output acks, got", ext, pos)
+	}
+
+	close(slow.release)
+	if batch := <-slow.flushed; len(batch) != 2 {
+		t.Fatal("slow output: got", len(batch))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ext, pos := committed(); ext == 1 && pos == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			ext, pos := committed()
+			t.Fatal("commit: got", ext, pos)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(exitCh)
+	<-done
+}
+
+func TestExportSlowOutput(t *testing.T) {
+	saved, savedLen := exitCh, outputQueueLen
+	exitCh, outputQueueLen = make(chan struct{}), 100
+	defer func() { exitCh, outputQueueLen = saved, savedLen }()
+
+	fast := &testOutput{flushed: make(chan []record, 10)}
+	slow := &testOutput{flushed: make(chan []record, 10), release: make(chan struct{})}
+	r := newRecords()
+	done := make(chan struct{})
+	go func() {
+		export(r, []output{fast, slow})
+		close(done)
+	}()
+	defer func() {
+		close(exitCh)
+		<-done
+	}()
+
+	// slow output never flushes, but fast output must receive all records
+	const n = 3000
+	go func() {
+		doc := map[string]interface{}{"@message": "hello"}
+		for i := 1; i <= n; i++ {
+			select {
+			case r.records <- record{dir: "/tmp/export/", pos: int64(i), doc: doc}:
+			case <-exitCh:
+				return
+			}
+		}
+	}()
+	got := 0
+	timeout := time.After(10 * time.Second)
+	for got < n {
+		select {
+		case batch := <-fast.flushed:
+			got += len(batch)
+		case <-timeout:
+			t.Fatal("fast output: got", got, "records")
+		}
+	}
+}
+
+func TestFileOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o, err := parseFileConf(map[string]string{"file.dir": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []string{"2020-01-02T10:00:00Z", "2020-01-03T10:00:00Z", "2020-01-02T11:00:00Z", "2020-01-03T01:00:00+05:30"} {
+		o.add(record{doc: map[string]interface{}{"@timestamp": ts}})
+	}
+	if cancelled := o.flush(); cancelled {
+		t.Fatal("must not be cancelled")
+	}
+	o.add(record{doc: map[string]interface{}{"@timestamp": "2020-01-02T12:00:00Z"}})
+	o.flush()
+	b, err := ioutil.ReadFile(filepath.Join(dir, "logflow-2020-01-02.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 4 {
+		t.Fatal("lines: got", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "logflow-2020-01-03.ndjson")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseExportConf(t *testing.T) {
+	defer func() { outputs = nil }()
+	if err := parseExportConf(map[string]string{"outputs": "elasticsearch, file", "elasticsearch.url": "http://es:9200", "file.dir": "/tmp"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 {
+		t.Fatal("got", len(outputs))
+	}
+	for _, m := range []map[string]string{
+		{},
+		{"outputs": "file"},
+		{"outputs": "s3", "file.dir": "/tmp"},
+		{"outputs": "file", "file.dir": "/tmp", "outputs.queue_size": "0"},
+	} {
+		if err := parseExportConf(m); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+}
@@ -16,10 +16,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/santhosh-tekuri/json"
@@ -106,25 +108,33 @@ func (p *parser) run() {
 	if err != nil {
 		panic(err)
 	}
-	a8n := &annotation{
-		de:    json.NewByteDecoder(nil),
-		deBuf: make([]byte, 1024),
-	}
+	a8n := newAnnotation()
+	a8n.rateLimit = namespaceRateLimit(m["namespace"])
 	if s, ok := m["annotation"]; ok {
 		delete(m, "annotation")
 		if err := a8n.unmarshal(s.(string)); err != nil {
 			warn("error in annotation of", m["pod"], "in", m["namespace"], ":", err)
+			a8n.err = err
+		}
+	}
+	var indexTemplate template
+	if s, ok := m["index"]; ok {
+		delete(m, "index")
+		if indexTemplate, err = compileTemplate(s.(string)); err != nil {
+			warn("error in logflow.io/index annotation of", m["pod"], "in", m["namespace"], ":", err)
 		}
 	}
 	k8s, err = json.Marshal(m)
 	if err != nil {
 		panic(err)
 	}
+	limit := newLimiter(a8n.rateLimit)
+	ns, _ := m["namespace"].(string)
+	redact := namespaceRedactor(ns)
+	held := newDedup(a8n.dedup)
 
-	var rec map[string]interface{}
-	sendRec := func() (exit bool) {
-		rec["@k8s"] = json.RawMessage(k8s)
-	L:
+	send := func(out record) (exit bool) {
+		out.dir, out.ns, out.k8s, out.indexTemplate = p.dir, ns, m, indexTemplate
 		for {
 			select {
 			case <-exitCh:
@@ -134,16 +144,105 @@ func (p *parser) run() {
 					_ = r.Close()
 					r = nil
 				}
-			case p.records <- record{
-				dir: p.dir,
-				ext: ext,
-				pos: pos,
-				doc: rec,
-			}:
-				break L
+			case p.records <- out:
+				return false
+			}
+		}
+	}
+
+	// waitQuota waits until daily quota of namespace is reset
+	waitQuota := func() (exit bool) {
+		for quota.exceeded(ns) {
+			select {
+			case <-exitCh:
+				return true
+			case <-p.removed:
+				if r != nil && !fileExists(f) {
+					_ = r.Close()
+					r = nil
+				}
+			case <-time.After(time.Minute):
+			}
+		}
+		return false
+	}
+
+	// flush sends the record held for deduplication
+	flush := func() (exit bool) {
+		if out, ok := held.take(); ok {
+			return send(out)
+		}
+		return false
+	}
+
+	var rec map[string]interface{}
+	dropped := false // whether records are dropped since last send
+
+	// sendRec sends rec to exporter. if rec is nil, only
+	// position is sent so that cursor moves past dropped records
+	sendRec := func() (exit bool) {
+		now := time.Now()
+		index := ""
+		if rec != nil {
+			if a8n.stack {
+				a8n.addStackTrace(rec)
+			}
+			applyTransforms(globalTransforms, rec)
+			applyTransforms(a8n.transforms, rec)
+			var drop bool
+			if drop, index = applyRules(globalRules, rec, m, index); !drop {
+				drop, index = applyRules(a8n.rules, rec, m, index)
+			}
+			msg, _ := rec["@message"].(string)
+			if drop || globalFilter.drop(rec, m) || a8n.filter.drop(rec, m) || !limit.allow(now, len(msg)) {
+				rec, dropped = nil, true
+				return false
+			}
+			redact.apply(rec)
+			if quota.exceeded(ns) {
+				if quotaMode == "warn" {
+					// records without level are not dropped
+					if sev, ok := rec["@severity"].(int); ok && sev < severities["warn"] {
+						rec, dropped = nil, true
+						return false
+					}
+				} else if exit := waitQuota(); exit {
+					return true
+				}
+			}
+			rec["@k8s"] = json.RawMessage(k8s)
+		}
+		out := record{ext: ext, pos: pos, doc: rec, index: index}
+		if rec != nil && held != nil {
+			if !held.absorb(out, now) {
+				if exit := flush(); exit {
+					return true
+				}
+				held.hold(out, now)
+			}
+		} else {
+			if exit := flush(); exit {
+				return true
+			}
+			if exit := send(out); exit {
+				return true
 			}
 		}
-		rec = nil
+		rec, dropped = nil, false
+		if limit.due(now) {
+			if exit := flush(); exit {
+				return true
+			}
+			n := limit.report(now)
+			return send(record{ext: ext, pos: pos, doc: map[string]interface{}{
+				"@message":    fmt.Sprintf("logflow: suppressed %d log lines exceeding rate limit", n),
+				"@timestamp":  now.UTC().Format(time.RFC3339Nano),
+				"@level":      "warn",
+				"@severity":   severities["warn"],
+				"@suppressed": n,
+				"@k8s":        json.RawMessage(k8s),
+			}})
+		}
 		return false
 	}
 
@@ -169,6 +268,11 @@ func (p *parser) run() {
 				pos = 0
 				nl.reset()
 				resetAdded()
+				if rec == nil && dropped {
+					if exit := sendRec(); exit {
+						return
+					}
+				}
 			}
 		}
 		l, err := nl.readFrom(r)
@@ -204,6 +308,11 @@ func (p *parser) run() {
 				continue
 			case <-timer.C:
 				wait += d
+				if now := time.Now(); rec == nil && (dropped || limit.due(now) || held.expired(now)) {
+					if exit := sendRec(); exit {
+						return
+					}
+				}
 				continue
 			}
 		case nil:
@@ -212,6 +321,7 @@ func (p *parser) run() {
 				if rec != nil {
 					sendRec()
 				}
+				flush()
 				_ = r.Close()
 				for {
 					select {
@@ -245,6 +355,11 @@ func (p *parser) run() {
 				warn(err)
 				break
 			}
+			if perr, ok := rec["@parse_error"]; ok {
+				if n := countParseError(p.dir); n == 1 {
+					warn("parse error in", m["pod"], "in", m["namespace"], ":", perr.(map[string]interface{})["reason"])
+				}
+			}
 			if a8n.multi == nil {
 				if exit := sendRec(); exit {
 					return
@@ -256,6 +371,18 @@ func (p *parser) run() {
 	}
 }
 
+var (
+	parseErrors   = make(map[string]int64) // number of records failed parsing, by container dir
+	parseErrorsMu = sync.Mutex{}
+)
+
+func countParseError(dir string) int64 {
+	parseErrorsMu.Lock()
+	defer parseErrorsMu.Unlock()
+	parseErrors[dir]++
+	return parseErrors[dir]
+}
+
 // rawLog ---
 
 type rawLog struct {
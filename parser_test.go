@@ -0,0 +1,116 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runTestParser writes given log files into new container dir, and
+// returns records sent by parser until END marker in last file
+func runTestParser(t *testing.T, k8s string, files ...[]string) []record {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "logflow-container")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".k8s"), []byte(k8s), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i, lines := range files {
+		var buf strings.Builder
+		for _, l := range lines {
+			fmt.Fprintf(&buf, `{"log":%q,"stream":"stdout","time":"2020-01-02T10:00:00Z"}`+"\n", l+"\n")
+		}
+		if i == len(files)-1 {
+			buf.WriteString("END\n")
+		}
+		if err := ioutil.WriteFile(getLogFile(dir, i), []byte(buf.String()), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := make(chan record)
+	p := &parser{
+		dir:     dir,
+		records: records,
+		closed:  make(chan struct{}),
+		added:   make(chan struct{}, 1),
+		removed: make(chan struct{}),
+	}
+	go p.run()
+	var list []record
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case rec := <-records:
+			if rec.ext == -1 {
+				return list
+			}
+			list = append(list, rec)
+		case <-timeout:
+			t.Fatal("parser did not finish")
+		}
+	}
+}
+
+func TestParserQuotaWarnMode(t *testing.T) {
+	savedQuota, savedMode := defaultQuota, quotaMode
+	defaultQuota, quotaMode = 1, "warn"
+	quota.mu.Lock()
+	quota.day, quota.used = today(), map[string]int64{"ns": 10}
+	quota.mu.Unlock()
+	defer func() {
+		defaultQuota, quotaMode = savedQuota, savedMode
+		quota.mu.Lock()
+		quota.used = make(map[string]int64)
+		quota.mu.Unlock()
+	}()
+
+	list := runTestParser(t, `{"namespace":"ns","pod":"web-1"}`, []string{"I0102 info", "W0102 warn", "no level"})
+	var msgs []string
+	for _, rec := range list {
+		if rec.doc != nil {
+			msgs = append(msgs, rec.doc["@message"].(string))
+		}
+	}
+	if want := []string{"W0102 warn", "no level"}; !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("got %q, want %q", msgs, want)
+	}
+}
+
+func TestParserRotationWithPendingRecord(t *testing.T) {
+	a8n := `format=/^(?P<msg>.*)$/\nmessage_key=msg\nmultiline_start=/^\\S/\ndrop_if=@message=~/healthz/`
+	k8s := `{"namespace":"ns","pod":"web-1","annotation":"` + a8n + `"}`
+	list := runTestParser(t, k8s,
+		[]string{"healthz", "start A"},
+		[]string{"  cont A", "start B"},
+	)
+	var msgs []string
+	for _, rec := range list {
+		if rec.doc != nil {
+			msgs = append(msgs, rec.doc["@message"].(string))
+		}
+	}
+	if want := []string{"start A\n  cont A", "start B"}; !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("got %q, want %q", msgs, want)
+	}
+}
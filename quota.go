@@ -0,0 +1,239 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/json"
+)
+
+// options
+var (
+	defaultQuota int64 // bytes per namespace per day. zero means unlimited
+	nsQuotas     = make(map[string]int64)
+	quotaMode    = "stop" // "stop" or "warn"
+)
+
+func quotaEnabled() bool {
+	return defaultQuota > 0 || len(nsQuotas) > 0
+}
+
+func quotaLimit(ns string) int64 {
+	if limit, ok := nsQuotas[ns]; ok {
+		return limit
+	}
+	return defaultQuota
+}
+
+func parseQuotaConf(m map[string]string) error {
+	parseBytes := func(k string) (int64, error) {
+		i, err := strconv.ParseInt(m[k], 10, 64)
+		if err != nil || i < 0 {
+			return 0, errors.New("invalid " + k + " " + m[k])
+		}
+		return i, nil
+	}
+	var err error
+	if _, ok := m["quota.bytes"]; ok {
+		if defaultQuota, err = parseBytes("quota.bytes"); err != nil {
+			return err
+		}
+	}
+	const nsPrefix = "quota.namespace."
+	for k := range m {
+		if strings.HasPrefix(k, nsPrefix) && strings.HasSuffix(k, ".bytes") {
+			ns := k[len(nsPrefix) : len(k)-len(".bytes")]
+			if nsQuotas[ns], err = parseBytes(k); err != nil {
+				return err
+			}
+		}
+	}
+	if s, ok := m["quota.mode"]; ok {
+		if s != "stop" && s != "warn" {
+			return errors.New("invalid quota.mode " + s)
+		}
+		quotaMode = s
+	}
+	return nil
+}
+
+// quotaUsage tracks bytes exported per namespace in current day.
+// it is persisted periodically, so that restarts do not reset the usage
+type quotaUsage struct {
+	mu    sync.Mutex
+	file  string
+	day   string // in utc
+	used  map[string]int64
+	dirty bool // whether usage changed since last save
+}
+
+var quota = &quotaUsage{
+	file: filepath.Join(qdir, ".quota"),
+	used: make(map[string]int64),
+}
+
+// quotaSaveInterval is how often usage is saved, if changed
+const quotaSaveInterval = 10 * time.Second
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// rollover resets usage, if day changed.
+// must be called with lock held
+func (q *quotaUsage) rollover() {
+	if day := today(); q.day != day {
+		q.day, q.dirty = day, true
+		q.used = make(map[string]int64)
+	}
+}
+
+func (q *quotaUsage) load() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b, err := ioutil.ReadFile(q.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warn(err)
+		}
+		return
+	}
+	m, err := jsonUnmarshal(b)
+	if err != nil {
+		warn("quota.load:", err)
+		return
+	}
+	if q.day, _ = m["day"].(string); q.day != today() {
+		return
+	}
+	used, _ := m["used"].(map[string]interface{})
+	for ns, v := range used {
+		if f, ok := v.(float64); ok {
+			q.used[ns] = int64(f)
+		}
+	}
+}
+
+// persist saves usage every quotaSaveInterval, and on exit
+func (q *quotaUsage) persist() {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exitCh:
+			q.save()
+			return
+		case <-ticker.C:
+			q.save()
+		}
+	}
+}
+
+// save writes usage to file, if it is changed since last save
+func (q *quotaUsage) save() {
+	q.mu.Lock()
+	q.rollover()
+	if !q.dirty {
+		q.mu.Unlock()
+		return
+	}
+	used := make(map[string]interface{}, len(q.used))
+	for ns, n := range q.used {
+		used[ns] = n
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"day":  q.day,
+		"used": used,
+	})
+	if err != nil {
+		panic(err)
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	tmp := q.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		warn(err)
+		return
+	}
+	if err := os.Rename(tmp, q.file); err != nil {
+		warn(err)
+	}
+}
+
+// add adds n bytes exported to usage of namespace ns
+func (q *quotaUsage) add(ns string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	before := q.used[ns]
+	q.used[ns] = before + n
+	q.dirty = true
+	if limit := quotaLimit(ns); limit > 0 && before < limit && before+n >= limit {
+		warn("daily quota exceeded for namespace", ns)
+	}
+}
+
+// recordSize estimates size of rec in bytes as json, without
+// encoding it. escaping of strings is not accounted
+func recordSize(rec record) int64 {
+	return int64(jsonSize(rec.doc))
+}
+
+func jsonSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case bool:
+		return 5
+	case string:
+		return len(v) + 2
+	case json.RawMessage:
+		return len(v)
+	case map[string]interface{}:
+		n := 2
+		for k, e := range v {
+			n += len(k) + 4 + jsonSize(e) // quotes, colon and comma
+		}
+		return n
+	case []interface{}:
+		n := 2
+		for _, e := range v {
+			n += jsonSize(e) + 1
+		}
+		return n
+	}
+	return 8 // number
+}
+
+// exceeded tells whether namespace ns exceeded its daily quota
+func (q *quotaUsage) exceeded(ns string) bool {
+	limit := quotaLimit(ns)
+	if limit == 0 {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover()
+	return q.used[ns] >= limit
+}
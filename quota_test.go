@@ -0,0 +1,96 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/santhosh-tekuri/json"
+)
+
+func TestQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() {
+		defaultQuota, nsQuotas = 0, make(map[string]int64)
+	}()
+	if err := parseQuotaConf(map[string]string{
+		"quota.bytes":                  "1000",
+		"quota.namespace.team-a.bytes": "100",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &quotaUsage{file: filepath.Join(dir, ".quota"), used: make(map[string]int64)}
+	q.add("team-a", 60)
+	q.add("team-b", 600)
+	if q.exceeded("team-a") || q.exceeded("team-b") {
+		t.Fatal("must not exceed")
+	}
+	q.add("team-a", 60)
+	if !q.exceeded("team-a") || q.exceeded("team-b") {
+		t.Fatal("only team-a must exceed")
+	}
+
+	// usage survives restart
+	q.save()
+	fi, err := os.Stat(q.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatal("mode: got", fi.Mode())
+	}
+	q = &quotaUsage{file: q.file, used: make(map[string]int64)}
+	q.load()
+	if q.used["team-a"] != 120 || q.used["team-b"] != 600 {
+		t.Fatal("got:", q.used)
+	}
+	if !q.exceeded("team-a") {
+		t.Fatal("team-a must exceed after load")
+	}
+
+	// usage is reset next day
+	q.day = "2000-01-01"
+	if q.exceeded("team-a") {
+		t.Fatal("must not exceed next day")
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	doc := map[string]interface{}{
+		"@message":   "GET /api/v1/users 200",
+		"@timestamp": "2020-01-02T10:00:00.123Z",
+		"@severity":  9,
+		"status":     float64(200),
+		"ok":         true,
+		"user":       map[string]interface{}{"id": "bob", "roles": []interface{}{"admin", "dev"}},
+		"@k8s":       json.RawMessage(`{"namespace":"prod","pod":"web-1"}`),
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := recordSize(record{doc: doc}), int64(len(b))
+	if got < want*9/10 || got > want*11/10 {
+		t.Fatal("got", got, "want about", want)
+	}
+}
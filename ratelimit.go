@@ -0,0 +1,176 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options
+var (
+	defaultRateLimit rateLimit
+	nsRateLimits     = make(map[string]rateLimit)
+)
+
+const suppressReportInterval = 30 * time.Second
+
+type rateLimit struct {
+	lines  float64 // lines per second
+	bytes  float64 // bytes per second
+	sample int     // if non-zero, one in every sample excess lines is kept
+}
+
+func (rl rateLimit) enabled() bool {
+	return rl.lines > 0 || rl.bytes > 0
+}
+
+func parseRateLimit(m map[string]string, prefix string, rl *rateLimit) error {
+	for _, k := range []string{"lines", "bytes", "sample"} {
+		s, ok := m[prefix+k]
+		if !ok {
+			continue
+		}
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return errors.New("invalid " + prefix + k + " " + s)
+		}
+		switch k {
+		case "lines":
+			rl.lines = float64(i)
+		case "bytes":
+			rl.bytes = float64(i)
+		default:
+			rl.sample = i
+		}
+	}
+	return nil
+}
+
+// parseRateLimitConf parses ratelimit.* and
+// ratelimit.namespace.NAMESPACE.* from logflow.conf
+func parseRateLimitConf(m map[string]string) error {
+	if err := parseRateLimit(m, "ratelimit.", &defaultRateLimit); err != nil {
+		return err
+	}
+	const nsPrefix = "ratelimit.namespace."
+	for k := range m {
+		if !strings.HasPrefix(k, nsPrefix) {
+			continue
+		}
+		dot := strings.LastIndexByte(k, '.')
+		if dot <= len(nsPrefix) {
+			return errors.New("invalid " + k + ", namespace missing")
+		}
+		ns := k[len(nsPrefix):dot]
+		if _, ok := nsRateLimits[ns]; ok {
+			continue
+		}
+		rl := defaultRateLimit
+		if err := parseRateLimit(m, nsPrefix+ns+".", &rl); err != nil {
+			return err
+		}
+		nsRateLimits[ns] = rl
+	}
+	return nil
+}
+
+func namespaceRateLimit(ns interface{}) rateLimit {
+	if s, ok := ns.(string); ok {
+		if rl, ok := nsRateLimits[s]; ok {
+			return rl
+		}
+	}
+	return defaultRateLimit
+}
+
+// limiter is token bucket rate limiter of a container.
+// bucket capacity is one second worth of tokens
+type limiter struct {
+	rl         rateLimit
+	lineTokens float64
+	byteTokens float64
+	last       time.Time
+	excess     int64 // number of lines exceeding rate limit
+	suppressed int64 // number of lines dropped, since last report
+	reported   time.Time
+}
+
+func newLimiter(rl rateLimit) *limiter {
+	if !rl.enabled() {
+		return nil
+	}
+	now := time.Now()
+	return &limiter{
+		rl:         rl,
+		lineTokens: rl.lines,
+		byteTokens: rl.bytes,
+		last:       now,
+		reported:   now,
+	}
+}
+
+// allow tells whether a line with n bytes can be sent
+func (l *limiter) allow(now time.Time, n int) bool {
+	if l == nil {
+		return true
+	}
+	elapsed := now.Sub(l.last).Seconds()
+	l.last = now
+	if l.rl.lines > 0 {
+		l.lineTokens = refill(l.lineTokens, elapsed, l.rl.lines)
+	}
+	if l.rl.bytes > 0 {
+		l.byteTokens = refill(l.byteTokens, elapsed, l.rl.bytes)
+	}
+	size := float64(n)
+	if size > l.rl.bytes {
+		// large lines are allowed when bucket is full
+		size = l.rl.bytes
+	}
+	if (l.rl.lines == 0 || l.lineTokens >= 1) && (l.rl.bytes == 0 || l.byteTokens >= size) {
+		l.lineTokens--
+		l.byteTokens -= float64(n)
+		return true
+	}
+	l.excess++
+	if l.rl.sample > 0 && l.excess%int64(l.rl.sample) == 0 {
+		return true
+	}
+	l.suppressed++
+	return false
+}
+
+func refill(tokens, elapsed, rate float64) float64 {
+	tokens += elapsed * rate
+	if tokens > rate {
+		return rate
+	}
+	return tokens
+}
+
+// due tells whether suppressed lines should be reported
+func (l *limiter) due(now time.Time) bool {
+	return l != nil && l.suppressed > 0 && now.Sub(l.reported) >= suppressReportInterval
+}
+
+// report returns number of lines suppressed since last report
+func (l *limiter) report(now time.Time) int64 {
+	n := l.suppressed
+	l.suppressed, l.reported = 0, now
+	return n
+}
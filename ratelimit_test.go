@@ -0,0 +1,129 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("lines", func(t *testing.T) {
+		l := newLimiter(rateLimit{lines: 10})
+		now := l.last
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if l.allow(now, 100) {
+				allowed++
+			}
+		}
+		if allowed != 10 || l.suppressed != 10 {
+			t.Fatal("allowed:", allowed, "suppressed:", l.suppressed)
+		}
+		// refill after half second
+		now = now.Add(500 * time.Millisecond)
+		allowed = 0
+		for i := 0; i < 20; i++ {
+			if l.allow(now, 100) {
+				allowed++
+			}
+		}
+		if allowed != 5 {
+			t.Fatal("allowed:", allowed)
+		}
+	})
+	t.Run("bytes", func(t *testing.T) {
+		l := newLimiter(rateLimit{bytes: 1000})
+		now := l.last
+		if !l.allow(now, 600) {
+			t.Fatal("must allow")
+		}
+		if l.allow(now, 600) {
+			t.Fatal("must not allow")
+		}
+		// large line is allowed when bucket is full
+		l = newLimiter(rateLimit{bytes: 1000})
+		if !l.allow(l.last, 5000) {
+			t.Fatal("must allow")
+		}
+	})
+	t.Run("sample", func(t *testing.T) {
+		l := newLimiter(rateLimit{lines: 1, sample: 5})
+		now := l.last
+		allowed := 0
+		for i := 0; i < 21; i++ {
+			if l.allow(now, 1) {
+				allowed++
+			}
+		}
+		if allowed != 1+4 || l.suppressed != 16 {
+			t.Fatal("allowed:", allowed, "suppressed:", l.suppressed)
+		}
+	})
+	t.Run("report", func(t *testing.T) {
+		l := newLimiter(rateLimit{lines: 1})
+		now := l.last
+		l.allow(now, 1)
+		l.allow(now, 1)
+		if l.due(now) {
+			t.Fatal("must not be due before interval")
+		}
+		now = now.Add(suppressReportInterval)
+		if !l.due(now) {
+			t.Fatal("must be due")
+		}
+		if n := l.report(now); n != 1 {
+			t.Fatal("got", n)
+		}
+		if l.due(now.Add(suppressReportInterval)) {
+			t.Fatal("must not be due, when nothing suppressed")
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		l := newLimiter(rateLimit{})
+		if !l.allow(time.Now(), 1) || l.due(time.Now()) {
+			t.Fatal("nil limiter must allow")
+		}
+	})
+}
+
+func TestParseRateLimitConf(t *testing.T) {
+	defer func() {
+		defaultRateLimit, nsRateLimits = rateLimit{}, make(map[string]rateLimit)
+	}()
+	err := parseRateLimitConf(map[string]string{
+		"ratelimit.lines":                  "100",
+		"ratelimit.namespace.team-a.lines": "10",
+		"ratelimit.namespace.team-a.bytes": "2000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := namespaceRateLimit("team-b"); got != (rateLimit{lines: 100}) {
+		t.Fatal("team-b:", got)
+	}
+	if got := namespaceRateLimit("team-a"); got != (rateLimit{lines: 10, bytes: 2000}) {
+		t.Fatal("team-a:", got)
+	}
+	for _, conf := range []map[string]string{
+		{"ratelimit.lines": "x"},
+		{"ratelimit.namespace.lines": "10"},
+		{"ratelimit.namespace..lines": "10"},
+	} {
+		if err := parseRateLimitConf(conf); err == nil {
+			t.Fatal(conf, "error expected")
+		}
+	}
+}
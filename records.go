@@ -16,67 +16,70 @@ package main
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"time"
 )
 
 var byteOrder = binary.BigEndian
 
 type records struct {
-	records     chan record
-	cursors     map[string]*cursor
-	timer       *time.Timer
-	timerActive bool
+	records chan record
+	cursors map[string]*cursor
+	marks   []mark // positions not yet acknowledged by outputs
+	acked   uint64 // seq of last record acknowledged by all outputs
+}
+
+// mark is position of container after record with seq
+type mark struct {
+	seq uint64
+	dir string
+	ext int
+	pos int64
 }
 
 func newRecords() *records {
-	timer := time.NewTimer(time.Hour)
-	timer.Stop()
 	return &records{
-		records:     make(chan record, 8000),
-		cursors:     make(map[string]*cursor),
-		timer:       timer,
-		timerActive: false,
+		records: make(chan record, 8000),
+		cursors: make(map[string]*cursor),
 	}
 }
 
-var errExit = errors.New("got exit signal")
-var errTimeout = errors.New("timeout")
+// mark remembers position of rec, which is the seq'th record
+// sent to outputs. if rec is not sent to outputs, seq is that
+// of last record sent
+func (r *records) mark(rec record, seq uint64) {
+	if seq <= r.acked {
+		r.move(rec.dir, rec.ext, rec.pos)
+		return
+	}
+	r.marks = append(r.marks, mark{seq, rec.dir, rec.ext, rec.pos})
+}
 
-func (r *records) next(timeout time.Duration) (record, error) {
-	for {
-		if r.timerActive {
-			if !r.timer.Stop() {
-				<-r.timer.C
-			}
-		}
-		r.timer.Reset(timeout)
-		r.timerActive = true
-		select {
-		case <-exitCh:
-			return record{}, errExit
-		case <-r.timer.C:
-			r.timerActive = false
-			return record{}, errTimeout
-		case rec := <-r.records:
-			cur, ok := r.cursors[rec.dir]
-			if !ok {
-				cur = newCursor(rec.dir)
-				r.cursors[rec.dir] = cur
-			}
-			cur.ext, cur.pos = rec.ext, rec.pos
-			if cur.ext == -1 {
-				continue
-			}
-			return rec, nil
-		}
+// ack moves cursors upto the record with given seq
+func (r *records) ack(seq uint64) {
+	r.acked = seq
+	i := 0
+	for i < len(r.marks) && r.marks[i].seq <= seq {
+		m := r.marks[i]
+		r.move(m.dir, m.ext, m.pos)
+		i++
+	}
+	if i > 0 {
+		r.marks = append(r.marks[:0], r.marks[i:]...)
 	}
 }
 
+func (r *records) move(dir string, ext int, pos int64) {
+	cur, ok := r.cursors[dir]
+	if !ok {
+		cur = newCursor(dir)
+		r.cursors[dir] = cur
+	}
+	cur.ext, cur.pos = ext, pos
+}
+
 func (r *records) commit() {
 	for _, cur := range r.cursors {
 		if finished := cur.commit(); finished {
@@ -87,9 +90,16 @@ func (r *records) commit() {
 
 type record struct {
 	dir string
+	ns  string
 	ext int
 	pos int64
 	doc map[string]interface{}
+
+	firstExt      int                    // ext of first record collapsed by dedup
+	firstPos      int64                  // pos of first record collapsed by dedup, zero if not collapsed
+	index         string                 // index prefix, if routed by rules
+	indexTemplate template               // index name from logflow.io/index annotation
+	k8s           map[string]interface{} // k8s metadata of container
 }
 
 type cursor struct {
@@ -0,0 +1,272 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/json"
+)
+
+// options
+var (
+	defaultRedactor *redactor
+	nsRedactors     = make(map[string]*redactor)
+)
+
+func namespaceRedactor(ns string) *redactor {
+	if r, ok := nsRedactors[ns]; ok {
+		return r
+	}
+	return defaultRedactor
+}
+
+type redactRule struct {
+	name  string
+	re    *regexp.Regexp // if it has group, only first group is redacted
+	check func(string) bool
+	key   *regexp.Regexp // values of fields with matching name are redacted entirely
+}
+
+var builtinRedactRules = map[string]redactRule{
+	"email": {
+		name: "email",
+		re:   regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	"card": {
+		name:  "card",
+		re:    regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		check: luhn,
+	},
+	"bearer": {
+		name: "bearer",
+		re:   regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	},
+	"password": {
+		name: "password",
+		re:   regexp.MustCompile(`(?i)\b(?:password|passwd|pwd|secret)["']?\s*[:=]\s*["']?([^\s"',;&]+)`),
+		// whole name or its last segment, such as db_password or userPassword
+		key: regexp.MustCompile(`^(?:.*[_.\-])?(?i:password|passwd|pwd|secret)$|[a-z0-9](?:Password|Passwd|Pwd|Secret)$`),
+	},
+}
+
+// redactor masks or hashes sensitive values
+type redactor struct {
+	rules   []redactRule
+	hash    bool
+	hashKey []byte // key for hmac, so that hashes cannot be brute forced
+}
+
+// parseRedactor parses PREFIX.rules, PREFIX.pattern.NAME, PREFIX.hash and PREFIX.hash_key.
+// base provides defaults for missing keys
+func parseRedactor(m map[string]string, prefix string, base *redactor) (*redactor, error) {
+	r := &redactor{}
+	if base != nil {
+		*r = *base
+		r.rules = append([]redactRule(nil), base.rules...)
+	}
+	if s, ok := m[prefix+"rules"]; ok {
+		var custom []redactRule
+		for _, rule := range r.rules {
+			if _, ok := builtinRedactRules[rule.name]; !ok {
+				custom = append(custom, rule)
+			}
+		}
+		r.rules = nil
+		for _, name := range strings.Split(s, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			rule, ok := builtinRedactRules[name]
+			if !ok {
+				return nil, errors.New("unknown " + prefix + "rules " + name)
+			}
+			r.rules = append(r.rules, rule)
+		}
+		r.rules = append(r.rules, custom...)
+	}
+	var names []string
+	for k := range m {
+		if strings.HasPrefix(k, prefix+"pattern.") {
+			names = append(names, k[len(prefix+"pattern."):])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := compileRegex(m[prefix+"pattern."+name])
+		if err != nil {
+			return nil, errors.New(prefix + "pattern." + name + ": " + err.Error())
+		}
+		r.rules = append(r.rules, redactRule{name: name, re: re})
+	}
+	if s, ok := m[prefix+"hash"]; ok {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.New("invalid " + prefix + "hash " + s)
+		}
+		r.hash = b
+	}
+	if s, ok := m[prefix+"hash_key"]; ok {
+		r.hashKey = []byte(s)
+	}
+	if r.hash && len(r.hashKey) == 0 {
+		return nil, errors.New(prefix + "hash_key missing")
+	}
+	if len(r.rules) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// parseRedactConf parses redact.* and redact.namespace.NAMESPACE.*
+func parseRedactConf(m map[string]string) error {
+	var err error
+	if defaultRedactor, err = parseRedactor(m, "redact.", nil); err != nil {
+		return err
+	}
+	const nsPrefix = "redact.namespace."
+	for k := range m {
+		if !strings.HasPrefix(k, nsPrefix) {
+			continue
+		}
+		ns := k[len(nsPrefix):]
+		if dot := strings.IndexByte(ns, '.'); dot != -1 {
+			ns = ns[:dot]
+		}
+		if _, ok := nsRedactors[ns]; ok || ns == "" {
+			continue
+		}
+		if nsRedactors[ns], err = parseRedactor(m, nsPrefix+ns+".", defaultRedactor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply redacts @message and all string fields of rec.
+// values of sensitive fields, at any depth, are redacted entirely
+func (r *redactor) apply(rec map[string]interface{}) {
+	if r == nil {
+		return
+	}
+	for k, v := range rec {
+		switch k {
+		case "@timestamp", "@level", "@k8s":
+			continue
+		}
+		rec[k] = r.redactField(k, v)
+	}
+}
+
+func (r *redactor) redactField(k string, v interface{}) interface{} {
+	if v == nil {
+		return v
+	}
+	for _, rule := range r.rules {
+		if rule.key != nil && rule.key.MatchString(k) {
+			s, ok := v.(string)
+			if !ok {
+				b, err := json.Marshal(v)
+				if err != nil {
+					panic(err)
+				}
+				s = string(b)
+			}
+			return r.replacement(rule.name, s)
+		}
+	}
+	return r.redactValue(v)
+}
+
+func (r *redactor) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.redact(v)
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = r.redactField(k, e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = r.redactValue(e)
+		}
+	}
+	return v
+}
+
+func (r *redactor) redact(s string) string {
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		var buf strings.Builder
+		last := 0
+		for _, m := range matches {
+			from, to := m[0], m[1]
+			if len(m) >= 4 && m[2] != -1 {
+				from, to = m[2], m[3]
+			}
+			if rule.check != nil && !rule.check(s[from:to]) {
+				continue
+			}
+			buf.WriteString(s[last:from])
+			buf.WriteString(r.replacement(rule.name, s[from:to]))
+			last = to
+		}
+		if last > 0 {
+			buf.WriteString(s[last:])
+			s = buf.String()
+		}
+	}
+	return s
+}
+
+func (r *redactor) replacement(name, v string) string {
+	if r.hash {
+		mac := hmac.New(sha256.New, r.hashKey)
+		mac.Write([]byte(v))
+		return "[" + name + ":" + hex.EncodeToString(mac.Sum(nil)[:8]) + "]"
+	}
+	return "[" + name + "]"
+}
+
+// luhn validates card number using luhn checksum
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
@@ -0,0 +1,139 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := parseRedactor(map[string]string{
+		"redact.rules":          "email,card,bearer,password",
+		"redact.pattern.apikey": "/key-[0-9a-f]{8}/",
+	}, "redact.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"mail bob@example.com now", "mail [email] now"},
+		{"card 4111 1111 1111 1111 paid", "card [card] paid"},
+		{"order 1234567890123 placed", "order 1234567890123 placed"}, // fails luhn
+		{"Authorization: Bearer abc.def-ghi", "Authorization: Bearer [bearer]"},
+		{`{"password":"s3cret","user":"x"}`, `{"password":"[password]","user":"x"}`},
+		{"login pwd=hunter2&x=1", "login pwd=[password]&x=1"},
+		{"using key-0123abcd", "using [apikey]"},
+		{"nothing here", "nothing here"},
+	}
+	for _, tt := range tests {
+		if got := r.redact(tt.in); got != tt.want {
+			t.Errorf("%q: got %q want %q", tt.in, got, tt.want)
+		}
+	}
+
+	rec := map[string]interface{}{
+		"@message":   "from bob@example.com",
+		"@timestamp": "2020-01-02T10:00:00Z",
+		"user":       map[string]interface{}{"email": "alice@example.com"},
+		"count$num":  float64(1),
+	}
+	r.apply(rec)
+	if rec["@message"] != "from [email]" || rec["user"].(map[string]interface{})["email"] != "[email]" {
+		t.Fatal("got:", rec)
+	}
+
+	// fields parsed from structured logs
+	rec, err = jsonUnmarshal([]byte(`{
+		"@message": "login",
+		"password": "hunter2",
+		"db": {"Password": "s3cret", "host": "db-0", "pwd": 1234},
+		"client_secret": {"id": "x"},
+		"userPassword": "x",
+		"pwd_changed_at": "2020-01-02",
+		"secretary": "alice",
+		"user": "bob"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.apply(rec)
+	want := map[string]interface{}{
+		"@message":       "login",
+		"password":       "[password]",
+		"db":             map[string]interface{}{"Password": "[password]", "host": "db-0", "pwd": "[password]"},
+		"client_secret":  "[password]",
+		"userPassword":   "[password]",
+		"pwd_changed_at": "2020-01-02",
+		"secretary":      "alice",
+		"user":           "bob",
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatal("got:", rec)
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	conf := map[string]string{"redact.rules": "email", "redact.hash": "true"}
+	if _, err := parseRedactor(conf, "redact.", nil); err == nil {
+		t.Fatal("hash_key must be required")
+	}
+	conf["redact.hash_key"] = "k1"
+	r, err := parseRedactor(conf, "redact.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := r.redact("bob@example.com"), r.redact("bob@example.com")
+	if x != y || !strings.HasPrefix(x, "[email:") || strings.Contains(x, "bob") {
+		t.Fatal("got:", x, y)
+	}
+	if r.redact("alice@example.com") == x {
+		t.Fatal("different values must have different hash")
+	}
+	conf["redact.hash_key"] = "k2"
+	if r, _ = parseRedactor(conf, "redact.", nil); r.redact("bob@example.com") == x {
+		t.Fatal("hash must depend on key")
+	}
+}
+
+func TestParseRedactConf(t *testing.T) {
+	defer func() {
+		defaultRedactor, nsRedactors = nil, make(map[string]*redactor)
+	}()
+	err := parseRedactConf(map[string]string{
+		"redact.rules":                          "email",
+		"redact.namespace.team-a.rules":         "card",
+		"redact.namespace.team-a.pattern.token": "/tok-\\w+/",
+		"redact.hash_key":                       "k1",
+		"redact.namespace.team-b.hash":          "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := namespaceRedactor("team-x").redact("bob@example.com tok-1"); got != "[email] tok-1" {
+		t.Fatal("team-x:", got)
+	}
+	if got := namespaceRedactor("team-a").redact("bob@example.com tok-1"); got != "bob@example.com [token]" {
+		t.Fatal("team-a:", got)
+	}
+	if got := namespaceRedactor("team-b").redact("bob@example.com"); !strings.HasPrefix(got, "[email:") {
+		t.Fatal("team-b:", got)
+	}
+	if err := parseRedactConf(map[string]string{"redact.rules": "phone"}); err == nil {
+		t.Fatal("error expected")
+	}
+}
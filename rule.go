@@ -0,0 +1,139 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// options
+var globalRules []rule
+
+// rule performs action on records matching condition.
+// it is specified as "CONDITION => ACTION" where action is one of:
+//
+//	drop              drops the record
+//	set(field, expr)  sets field to value of expr
+//	index(expr)       routes the record to index prefix given by expr
+type rule struct {
+	name   string
+	cond   node
+	action string
+	field  string
+	value  node
+}
+
+// parseRules parses rules with given prefix in name order
+func parseRules(m map[string]string, prefix string) ([]rule, error) {
+	var list []rule
+	for k, v := range m {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		r, err := compileRule(k[len(prefix):], v)
+		if err != nil {
+			return nil, errors.New("invalid " + k + ": " + err.Error())
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list, nil
+}
+
+func compileRule(name, s string) (rule, error) {
+	r := rule{name: name}
+	p := &exprParser{lex: exprLexer{s: s}}
+	p.next()
+	var err error
+	if r.cond, err = p.parse(); err != nil {
+		return r, err
+	}
+	if err = p.expect("=>"); err != nil {
+		return r, err
+	}
+	if p.tok.kind != tokIdent {
+		return r, p.errorf("action expected")
+	}
+	r.action = p.tok.s
+	p.next()
+	switch r.action {
+	case "drop":
+	case "set", "index":
+		if !p.isOp("(") {
+			return r, p.errorf("%q expected", "(")
+		}
+		args, err := p.parseArgs()
+		if err != nil {
+			return r, err
+		}
+		if r.action == "set" {
+			if len(args) != 2 {
+				return r, errors.New("set expects 2 arguments")
+			}
+			f, ok := args[0].(*fieldNode)
+			if !ok {
+				return r, errors.New("set expects field")
+			}
+			if f.path == "@timestamp" || f.path == "@message" || strings.HasPrefix(f.path, "@k8s") {
+				return r, errors.New(f.path + " cannot be modified")
+			}
+			r.field, r.value = f.path, args[1]
+		} else {
+			if len(args) != 1 {
+				return r, errors.New("index expects 1 argument")
+			}
+			r.value = args[0]
+		}
+	default:
+		return r, errors.New("unknown action " + r.action)
+	}
+	if p.err != nil {
+		return r, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return r, p.errorf("unexpected %q", p.tok.s)
+	}
+	return r, nil
+}
+
+// applyRules applies rules on rec in order. it tells whether rec
+// should be dropped and the index to which it is routed, if any
+func applyRules(list []rule, rec, k8s map[string]interface{}, index string) (drop bool, idx string) {
+	env := &exprEnv{rec: rec, k8s: k8s}
+	for _, r := range list {
+		if !evalBool(r.cond, env) {
+			continue
+		}
+		switch r.action {
+		case "drop":
+			return true, index
+		case "set":
+			if v := r.value.eval(env); v != nil {
+				rec[r.field] = v
+			} else {
+				delete(rec, r.field)
+			}
+		case "index":
+			if s, ok := r.value.eval(env).(string); ok && s != "" {
+				index = s
+			}
+		}
+	}
+	return false, index
+}
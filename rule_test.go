@@ -0,0 +1,70 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestRules(t *testing.T) {
+	list, err := parseRules(map[string]string{
+		"rule.1drop":  `@k8s.namespace.startsWith("team-a") && @level == "debug" && @k8s.labels.canary != "true" => drop`,
+		"rule.2class": `status >= 500 => set(status_class, "5xx")`,
+		"rule.3route": `has(audit) => index("audit-" + @k8s.namespace + "-")`,
+		"other":       "x",
+	}, "rule.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k8s := map[string]interface{}{
+		"namespace": "team-a",
+		"labels":    map[string]interface{}{"canary": "false"},
+	}
+
+	rec := map[string]interface{}{"@level": "debug"}
+	if drop, _ := applyRules(list, rec, k8s, ""); !drop {
+		t.Fatal("must drop")
+	}
+
+	rec = map[string]interface{}{"@level": "error", "status": float64(502), "audit": true}
+	drop, index := applyRules(list, rec, k8s, "")
+	if drop || index != "audit-team-a-" || rec["status_class"] != "5xx" {
+		t.Fatal("got", drop, index, rec)
+	}
+
+	rec = map[string]interface{}{"@level": "info"}
+	if drop, index := applyRules(list, rec, k8s, "x-"); drop || index != "x-" || len(rec) != 1 {
+		t.Fatal("got", drop, index, rec)
+	}
+}
+
+func TestParseRulesError(t *testing.T) {
+	tests := []string{
+		`a == 1`,
+		`a == 1 =>`,
+		`a == 1 => delete`,
+		`a == 1 => set(x)`,
+		`a == 1 => set("x", 1)`,
+		`a == 1 => set(@timestamp, 1)`,
+		`a == 1 => set(@k8s.namespace, 1)`,
+		`a == 1 => set(@message, 12)`,
+		`a == 1 => set(@message, null)`,
+		`a == 1 => index()`,
+		`a == 1 => drop drop`,
+	}
+	for _, s := range tests {
+		if _, err := parseRules(map[string]string{"rule.x": s}, "rule."); err == nil {
+			t.Errorf("%q: error expected", s)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// sasl ---
+
+// saslMechanism performs authentication exchange. step is called
+// with nil challenge first, and returns response to be sent.
+// done is true when no more responses are to be sent
+type saslMechanism interface {
+	name() string
+	step(challenge []byte) (response []byte, done bool, err error)
+}
+
+func newSASLMechanism(name, user, pass string) (saslMechanism, error) {
+	switch name {
+	case "PLAIN":
+		return &saslPlain{user: user, pass: pass}, nil
+	case "SCRAM-SHA-256":
+		return &scram{mechanism: name, hash: sha256.New, user: user, pass: pass}, nil
+	case "SCRAM-SHA-512":
+		return &scram{mechanism: name, hash: sha512.New, user: user, pass: pass}, nil
+	}
+	return nil, errors.New("unsupported sasl mechanism " + name)
+}
+
+type saslPlain struct {
+	user, pass string
+}
+
+func (p *saslPlain) name() string {
+	return "PLAIN"
+}
+
+func (p *saslPlain) step([]byte) ([]byte, bool, error) {
+	return []byte("\x00" + p.user + "\x00" + p.pass), true, nil
+}
+
+// scram implements rfc5802 without channel binding
+type scram struct {
+	mechanism  string
+	hash       func() hash.Hash
+	user, pass string
+
+	state       int
+	nonce       string
+	clientFirst string // client first message without gs2 header
+	serverSig   []byte
+}
+
+func (s *scram) name() string {
+	return s.mechanism
+}
+
+var scramEscaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+func (s *scram) step(challenge []byte) ([]byte, bool, error) {
+	s.state++
+	switch s.state {
+	case 1:
+		if s.nonce == "" {
+			b := make([]byte, 24)
+			if _, err := rand.Read(b); err != nil {
+				return nil, false, err
+			}
+			s.nonce = base64.RawStdEncoding.EncodeToString(b)
+		}
+		s.clientFirst = "n=" + scramEscaper.Replace(s.user) + ",r=" + s.nonce
+		return []byte("n,," + s.clientFirst), false, nil
+	case 2:
+		serverFirst := string(challenge)
+		attrs := scramAttrs(serverFirst)
+		nonce, salt64, iter64 := attrs["r"], attrs["s"], attrs["i"]
+		if !strings.HasPrefix(nonce, s.nonce) {
+			return nil, false, errors.New("scram: invalid server nonce")
+		}
+		salt, err := base64.StdEncoding.DecodeString(salt64)
+		if err != nil {
+			return nil, false, errors.New("scram: invalid salt")
+		}
+		iter, err := strconv.Atoi(iter64)
+		if err != nil || iter <= 0 {
+			return nil, false, errors.New("scram: invalid iteration count")
+		}
+		salted := pbkdf2(s.hash, []byte(s.pass), salt, iter)
+		clientKey := hmacSum(s.hash, salted, []byte("Client Key"))
+		h := s.hash()
+		h.Write(clientKey)
+		storedKey := h.Sum(nil)
+		clientFinal := "c=biws,r=" + nonce
+		authMessage := []byte(s.clientFirst + "," + serverFirst + "," + clientFinal)
+		proof := hmacSum(s.hash, storedKey, authMessage)
+		for i := range proof {
+			proof[i] ^= clientKey[i]
+		}
+		serverKey := hmacSum(s.hash, salted, []byte("Server Key"))
+		s.serverSig = hmacSum(s.hash, serverKey, authMessage)
+		return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), false, nil
+	case 3:
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, false, errors.New("scram: " + e)
+		}
+		sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(sig, s.serverSig) {
+			return nil, false, errors.New("scram: invalid server signature")
+		}
+		return nil, true, nil
+	}
+	return nil, false, errors.New("scram: unexpected challenge")
+}
+
+func scramAttrs(s string) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if len(kv) > 2 && kv[1] == '=' {
+			m[kv[:1]] = kv[2:]
+		}
+	}
+	return m
+}
+
+func hmacSum(h func() hash.Hash, key, msg []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 derives key of hash size, as in rfc2898
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	u := hmacSum(h, password, append(append([]byte(nil), salt...), 0, 0, 0, 1))
+	key := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		u = hmacSum(h, password, u)
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
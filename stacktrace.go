@@ -0,0 +1,169 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// addStackTrace adds error object with type, message and stack_hash
+// fields to rec, if its message contains a stack trace. type_conflict
+// of a8n is applied on error field, as apps may log error field
+// with different type
+func (a8n *annotation) addStackTrace(rec map[string]interface{}) {
+	msg, ok := rec["@message"].(string)
+	if !ok || strings.IndexByte(msg, '\n') == -1 {
+		return
+	}
+	st, ok := parseStackTrace(msg)
+	if !ok {
+		return
+	}
+	e := map[string]interface{}{
+		"type":       st.typ,
+		"message":    st.msg,
+		"stack_hash": st.hash(),
+	}
+	for k, v := range a8n.resolveTypes(map[string]interface{}{"error": e}) {
+		mergeField(rec, k, v)
+	}
+}
+
+type stackTrace struct {
+	typ    string
+	msg    string
+	frames []string // normalized frames
+}
+
+// hash returns hash of exception type and frames.
+// line numbers are stripped from frames, so that same
+// crash from different builds yield same hash
+func (st stackTrace) hash() string {
+	h := sha1.New()
+	h.Write([]byte(st.typ))
+	for _, f := range st.frames {
+		h.Write([]byte{'\n'})
+		h.Write([]byte(f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseStackTrace detects java, go, python and javascript
+// stack traces in given multiline message
+func parseStackTrace(msg string) (stackTrace, bool) {
+	lines := strings.Split(msg, "\n")
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "Traceback (most recent call last):"):
+			return pythonTrace(lines[i+1:])
+		case strings.HasPrefix(l, "panic: "), strings.HasPrefix(l, "fatal error: "):
+			return goTrace(lines[i:])
+		case i > 0 && isAtFrame(l):
+			return atTrace(lines[i-1:])
+		}
+	}
+	return stackTrace{}, false
+}
+
+var (
+	reExceptionHeader = regexp.MustCompile(`^(?:Exception in thread "[^"]*" )?(?:Caused by: )?([A-Za-z_$][\w$.]*)(?::\s*(.*))?$`)
+	reLineNumbers     = regexp.MustCompile(`(:\d+)+(\)?)$`)
+	reGoArgs          = regexp.MustCompile(`\(.*\)$`)
+	reGoFileLine      = regexp.MustCompile(`:\d+( \+0x[0-9a-f]+)?$`)
+	rePyLine          = regexp.MustCompile(`, line \d+`)
+)
+
+func isAtFrame(l string) bool {
+	return (strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t")) && strings.HasPrefix(strings.TrimSpace(l), "at ")
+}
+
+// atTrace parses java and javascript traces.
+// lines[0] is exception header followed by frames
+func atTrace(lines []string) (stackTrace, bool) {
+	g := reExceptionHeader.FindStringSubmatch(strings.TrimSpace(lines[0]))
+	if g == nil {
+		return stackTrace{}, false
+	}
+	st := stackTrace{typ: g[1], msg: g[2]}
+	for _, l := range lines[1:] {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "at "):
+			st.frames = append(st.frames, reLineNumbers.ReplaceAllString(l, "$2"))
+		case strings.HasPrefix(l, "Caused by: "):
+			if g := reExceptionHeader.FindStringSubmatch(l); g != nil {
+				st.frames = append(st.frames, "Caused by: "+g[1])
+			}
+		case strings.HasPrefix(l, "..."):
+		default:
+			return st, true
+		}
+	}
+	return st, true
+}
+
+// goTrace parses panic message followed by
+// stack trace of the panicking goroutine
+func goTrace(lines []string) (stackTrace, bool) {
+	var st stackTrace
+	if strings.HasPrefix(lines[0], "panic: ") {
+		st.typ, st.msg = "panic", lines[0][len("panic: "):]
+		st.msg = strings.TrimSuffix(st.msg, " [recovered]")
+	} else {
+		st.typ, st.msg = "fatal error", lines[0][len("fatal error: "):]
+	}
+	i := 1
+	for i < len(lines) && !strings.HasPrefix(lines[i], "goroutine ") {
+		i++
+	}
+	if i == len(lines) {
+		return stackTrace{}, false
+	}
+	for _, l := range lines[i+1:] {
+		if strings.TrimSpace(l) == "" {
+			break
+		}
+		if strings.HasPrefix(l, "\t") {
+			st.frames = append(st.frames, reGoFileLine.ReplaceAllString(strings.TrimSpace(l), ""))
+		} else {
+			st.frames = append(st.frames, reGoArgs.ReplaceAllString(l, "()"))
+		}
+	}
+	return st, len(st.frames) > 0
+}
+
+// pythonTrace parses lines following "Traceback (most recent call last):"
+func pythonTrace(lines []string) (stackTrace, bool) {
+	var st stackTrace
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "  File "):
+			st.frames = append(st.frames, rePyLine.ReplaceAllString(strings.TrimSpace(l), ""))
+		case strings.HasPrefix(l, " "):
+			// source line of the frame
+		default:
+			g := reExceptionHeader.FindStringSubmatch(l)
+			if g == nil {
+				return stackTrace{}, false
+			}
+			st.typ, st.msg = g[1], g[2]
+			return st, true
+		}
+	}
+	return stackTrace{}, false
+}
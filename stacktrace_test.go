@@ -0,0 +1,132 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStackTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   string
+		msg2  string // same crash with different line numbers
+		typ   string
+		emsg  string
+		nomsg bool
+	}{
+		{
+			name: "java",
+			msg:  "2020-01-02 ERROR request failed\njava.lang.IllegalStateException: bad state\n\tat com.foo.Bar.run(Bar.java:12)\n\tat com.foo.Main.main(Main.java:5)\nCaused by: java.io.IOException: eof\n\tat com.foo.Baz.read(Baz.java:7)\n\t... 2 more",
+			msg2: "2020-01-03 ERROR request failed\njava.lang.IllegalStateException: other state\n\tat com.foo.Bar.run(Bar.java:14)\n\tat com.foo.Main.main(Main.java:5)\nCaused by: java.io.IOException: eof\n\tat com.foo.Baz.read(Baz.java:9)\n\t... 2 more",
+			typ:  "java.lang.IllegalStateException",
+			emsg: "bad state",
+		},
+		{
+			name: "javaThread",
+			msg:  "Exception in thread \"main\" java.lang.NullPointerException\n\tat com.foo.Main.main(Main.java:5)",
+			msg2: "Exception in thread \"worker\" java.lang.NullPointerException\n\tat com.foo.Main.main(Main.java:6)",
+			typ:  "java.lang.NullPointerException",
+			emsg: "",
+		},
+		{
+			name: "go",
+			msg:  "panic: runtime error: index out of range [recovered]\n\ngoroutine 1 [running]:\nmain.foo(0xc000010000, 0x1)\n\t/app/main.go:12 +0x1d\nmain.main()\n\t/app/main.go:5 +0x2a\n\ngoroutine 2 [sleep]:\nmain.bar()",
+			msg2: "panic: runtime error: index out of range [recovered]\n\ngoroutine 7 [running]:\nmain.foo(0xc000020000, 0x2)\n\t/app/main.go:13 +0x1f\nmain.main()\n\t/app/main.go:5 +0x2a",
+			typ:  "panic",
+			emsg: "runtime error: index out of range",
+		},
+		{
+			name: "python",
+			msg:  "Traceback (most recent call last):\n  File \"app.py\", line 10, in <module>\n    main()\n  File \"app.py\", line 5, in main\n    raise ValueError(\"bad value\")\nValueError: bad value",
+			msg2: "Traceback (most recent call last):\n  File \"app.py\", line 11, in <module>\n    main()\n  File \"app.py\", line 6, in main\n    raise ValueError(\"bad value\")\nValueError: bad value",
+			typ:  "ValueError",
+			emsg: "bad value",
+		},
+		{
+			name: "javascript",
+			msg:  "TypeError: Cannot read property 'x' of undefined\n    at foo (/app/index.js:12:5)\n    at /app/index.js:20:3",
+			msg2: "TypeError: Cannot read property 'y' of undefined\n    at foo (/app/index.js:14:7)\n    at /app/index.js:22:3",
+			typ:  "TypeError",
+			emsg: "Cannot read property 'x' of undefined",
+		},
+		{
+			name:  "noTrace",
+			msg:   "line1\n  line2\nline3",
+			nomsg: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, ok := parseStackTrace(tt.msg)
+			if ok == tt.nomsg {
+				t.Fatal("ok: got", ok, "want", !tt.nomsg)
+			}
+			if tt.nomsg {
+				return
+			}
+			if st.typ != tt.typ {
+				t.Fatalf("type: got %q want %q", st.typ, tt.typ)
+			}
+			if st.msg != tt.emsg {
+				t.Fatalf("message: got %q want %q", st.msg, tt.emsg)
+			}
+			st2, ok := parseStackTrace(tt.msg2)
+			if !ok {
+				t.Fatal("msg2 not parsed")
+			}
+			if st.hash() != st2.hash() {
+				t.Log(" got:", st.frames)
+				t.Log("want:", st2.frames)
+				t.Fatal("hash mismatch")
+			}
+		})
+	}
+}
+
+func TestAddStackTrace(t *testing.T) {
+	msg := "TypeError: bad value\n    at foo (/app/index.js:12:5)"
+	st, _ := parseStackTrace(msg)
+	tests := []struct {
+		a8n  string
+		want string
+	}{
+		{"type_conflict=suffix", `{"error$obj":{"code":"E1","type":"TypeError","message":"bad value","stack_hash":"HASH"}}`},
+		{"type_conflict=flatten", `{"error.code":"E1","error.type":"TypeError","error.message":"bad value","error.stack_hash":"HASH"}`},
+		{"type_conflict=nest\nnest_key=app", `{"app":{"error":{"code":"E1","type":"TypeError","message":"bad value","stack_hash":"HASH"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a8n, func(t *testing.T) {
+			a8n := newTestAnnotation(t, "format=json\nmessage_key=msg\n"+tt.a8n)
+			rec, err := a8n.jsonUnmarshal(`{"error":{"code":"E1"}}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec = a8n.resolveTypes(rec)
+			rec["@message"] = msg
+			a8n.addStackTrace(rec)
+			delete(rec, "@message")
+			want, err := jsonUnmarshal([]byte(strings.ReplaceAll(tt.want, "HASH", st.hash())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec, want) {
+				t.Fatalf(" got: %v\nwant: %v", rec, want)
+			}
+		})
+	}
+}
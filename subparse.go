@@ -0,0 +1,174 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// subparser parses value of a field produced by annotation.parse
+type subparser struct {
+	field  string
+	format string // "json" or "logfmt"
+	nest   bool   // if true, result replaces the field, otherwise merged into record
+}
+
+func parseSubparsers(m map[string]string) ([]subparser, error) {
+	var sp []subparser
+	for k, v := range m {
+		if !strings.HasPrefix(k, "subparse.") {
+			continue
+		}
+		p := subparser{field: k[len("subparse."):]}
+		if p.field == "" || p.field[0] == '@' {
+			return nil, errors.New("invalid field in " + k)
+		}
+		p.format = v
+		if comma := strings.IndexByte(v, ','); comma != -1 {
+			p.format = strings.TrimSpace(v[:comma])
+			if opt := strings.TrimSpace(v[comma+1:]); opt != "nest" {
+				return nil, errors.New("invalid option " + opt + " in " + k)
+			}
+			p.nest = true
+		}
+		if p.format != "json" && p.format != "logfmt" {
+			return nil, errors.New("invalid format " + p.format + " in " + k)
+		}
+		sp = append(sp, p)
+	}
+	sort.Slice(sp, func(i, j int) bool {
+		return sp[i].field < sp[j].field
+	})
+	return sp, nil
+}
+
+// subparse applies subparsers on rec. fields which
+// cannot be parsed are left unchanged, and the first
+// such failure is returned
+func (a8n *annotation) subparse(rec map[string]interface{}) (format string, failure error) {
+	for _, p := range a8n.subparsers {
+		s, ok := rec[p.field].(string)
+		if !ok || s == "" {
+			continue
+		}
+		var m map[string]interface{}
+		var err error
+		if p.format == "json" {
+			m, err = a8n.jsonUnmarshal(s)
+		} else {
+			m, err = parseLogfmt(s)
+		}
+		if err != nil {
+			if failure == nil {
+				format, failure = p.format, errors.New("subparse."+p.field+": "+err.Error())
+			}
+			continue
+		}
+		delete(rec, p.field)
+		if p.nest {
+			// type_conflict is applied on FIELD, as it is now object
+			for k, v := range a8n.resolveTypes(map[string]interface{}{p.field: m}) {
+				mergeField(rec, k, v)
+			}
+			continue
+		}
+		m = a8n.resolveTypes(m)
+		for k, v := range m {
+			if _, ok := rec[k]; !ok {
+				rec[k] = v
+			}
+		}
+	}
+	return
+}
+
+// mergeField sets rec[k] to v. if both are objects, as with
+// type_conflict=nest, fields of v are merged recursively into existing object
+func mergeField(rec map[string]interface{}, k string, v interface{}) {
+	if dst, ok := rec[k].(map[string]interface{}); ok {
+		if src, ok := v.(map[string]interface{}); ok {
+			for k, v := range src {
+				mergeField(dst, k, v)
+			}
+			return
+		}
+	}
+	rec[k] = v
+}
+
+var errLogfmt = errors.New("invalid logfmt")
+
+// parseLogfmt parses space separated key=value pairs.
+// values can be double quoted. keys without value
+// are mapped to empty string. plain text, without any
+// key=value pair, is not treated as logfmt
+func parseLogfmt(s string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	pairs := 0
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			break
+		}
+		i := strings.IndexAny(s, "= \t")
+		if i == 0 {
+			return nil, errLogfmt
+		}
+		if i == -1 || s[i] != '=' {
+			if i == -1 {
+				i = len(s)
+			}
+			m[s[:i]] = ""
+			s = s[i:]
+			continue
+		}
+		key := s[:i]
+		s = s[i+1:]
+		pairs++
+		if strings.HasPrefix(s, `"`) {
+			j := 1
+			for ; j < len(s); j++ {
+				if s[j] == '\\' {
+					j++
+				} else if s[j] == '"' {
+					break
+				}
+			}
+			if j >= len(s) {
+				return nil, errLogfmt
+			}
+			v, err := strconv.Unquote(s[:j+1])
+			if err != nil {
+				return nil, errLogfmt
+			}
+			m[key] = v
+			s = s[j+1:]
+		} else {
+			j := strings.IndexAny(s, " \t")
+			if j == -1 {
+				j = len(s)
+			}
+			m[key] = s[:j]
+			s = s[j:]
+		}
+	}
+	if pairs == 0 {
+		return nil, errLogfmt
+	}
+	return m, nil
+}
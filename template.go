@@ -0,0 +1,125 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// template is a name with {FIELD} placeholders, which are
+// replaced with values of @k8s fields. for example: logs-{namespace}.
+// {label.NAME} is shorthand for {labels.NAME}.
+//
+// placeholder made of yyyy, yy, MM, dd, HH and separators is replaced
+// with record timestamp. for example: logs-{yyyy.MM.dd}
+type template []templatePart
+
+type templatePart struct {
+	lit   string
+	field string
+	date  string // go layout, if date placeholder
+}
+
+func (p templatePart) isLit() bool {
+	return p.field == "" && p.date == ""
+}
+
+func compileTemplate(s string) (template, error) {
+	var t template
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open == -1 {
+			if strings.IndexByte(s, '}') != -1 {
+				return nil, errors.New("unbalanced braces")
+			}
+			t = append(t, templatePart{lit: s})
+			break
+		}
+		if open > 0 {
+			if strings.IndexByte(s[:open], '}') != -1 {
+				return nil, errors.New("unbalanced braces")
+			}
+			t = append(t, templatePart{lit: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end == -1 {
+			return nil, errors.New("unbalanced braces")
+		}
+		field := strings.TrimSpace(s[open+1 : open+end])
+		if field == "" {
+			return nil, errors.New("empty placeholder")
+		}
+		if layout, ok := dateLayout(field); ok {
+			t = append(t, templatePart{date: layout})
+		} else {
+			if strings.HasPrefix(field, "label.") {
+				field = "labels." + field[len("label."):]
+			}
+			t = append(t, templatePart{field: field})
+		}
+		s = s[open+end+1:]
+	}
+	return t, nil
+}
+
+var dateTokens = strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15")
+
+// dateLayout converts date placeholder such as yyyy.MM.dd to go layout
+func dateLayout(s string) (string, bool) {
+	layout := dateTokens.Replace(s)
+	for _, c := range layout {
+		if !strings.ContainsRune("0123456789.-_", c) {
+			return "", false
+		}
+	}
+	return layout, layout != s
+}
+
+// hasDate tells whether t has date placeholder
+func (t template) hasDate() bool {
+	for _, p := range t {
+		if p.date != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// expand returns t with placeholders replaced. missing fields are
+// replaced with empty string, and reported by ok
+func (t template) expand(k8s map[string]interface{}, ts time.Time) (s string, ok bool) {
+	if len(t) == 1 && t[0].isLit() {
+		return t[0].lit, true
+	}
+	var buf strings.Builder
+	ok = true
+	for _, p := range t {
+		switch {
+		case p.date != "":
+			buf.WriteString(ts.Format(p.date))
+		case p.field == "":
+			buf.WriteString(p.lit)
+		default:
+			if v, found := lookupField(k8s, p.field); found && v != nil {
+				buf.WriteString(sprint(v))
+			} else {
+				ok = false
+			}
+		}
+	}
+	return buf.String(), ok
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemplate(t *testing.T) {
+	k8s := map[string]interface{}{
+		"namespace": "prod",
+		"pod":       "web-1",
+		"labels":    map[string]interface{}{"app": "shop"},
+	}
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	tests := []struct {
+		s, want string
+		ok      bool
+	}{
+		{"logflow", "logflow", true},
+		{"logs-{namespace}", "logs-prod", true},
+		{"{namespace}-{label.app}-{pod}", "prod-shop-web-1", true},
+		{"{labels.app}", "shop", true},
+		{"logs-{label.missing}", "logs-", false},
+		{"{namespace}-{yyyy.MM.dd}", "prod-2019.03.04", true},
+		{"logs-{yy_MM_dd-HH}", "logs-19_03_04-05", true},
+	}
+	for _, test := range tests {
+		tmpl, err := compileTemplate(test.s)
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		if got, ok := tmpl.expand(k8s, ts); got != test.want || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v", test.s, got, ok, test.want, test.ok)
+		}
+	}
+	for _, s := range []string{"logs-{namespace", "logs-}", "logs-{}", "{a}}"} {
+		if _, err := compileTemplate(s); err == nil {
+			t.Errorf("%q: error expected", s)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// options
+var globalTransforms []transform
+
+// transform is a field processor applied on log record
+type transform struct {
+	op   string
+	args []string
+}
+
+var transformArgs = map[string]int{
+	"add":       2, // add(field,value)
+	"remove":    -1,
+	"rename":    2, // rename(from,to)
+	"copy":      2, // copy(from,to)
+	"lowercase": -1,
+	"nest":      1, // nest(field) moves all non @ fields under field
+}
+
+// parseTransformConf parses transforms from keys with given prefix,
+// such as transform.NAME. like rules, they are applied in name order
+func parseTransformConf(m map[string]string, prefix string) ([]transform, error) {
+	if _, ok := m[strings.TrimSuffix(prefix, ".")]; ok {
+		return nil, errors.New(strings.TrimSuffix(prefix, ".") + " is not supported, use " + prefix + "NAME, for example " + prefix + "env=add(env,prod)")
+	}
+	var names []string
+	for k := range m {
+		if strings.HasPrefix(k, prefix) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var list []transform
+	for _, k := range names {
+		if k == prefix {
+			return nil, errors.New("invalid " + k + ", name missing")
+		}
+		t, err := parseTransforms(m[k])
+		if err != nil {
+			return nil, errors.New("invalid " + k + ": " + err.Error())
+		}
+		list = append(list, t...)
+	}
+	return list, nil
+}
+
+// parseTransforms parses transforms separated by ';'
+// for example: remove(noisy); rename(msg2,detail); add(env,prod)
+func parseTransforms(s string) ([]transform, error) {
+	var list []transform
+	for _, t := range strings.Split(s, ";") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		open := strings.IndexByte(t, '(')
+		if open == -1 || t[len(t)-1] != ')' {
+			return nil, errors.New("invalid transform " + t)
+		}
+		tr := transform{op: strings.TrimSpace(t[:open])}
+		n, ok := transformArgs[tr.op]
+		if !ok {
+			return nil, errors.New("unknown transform " + tr.op)
+		}
+		inner := t[open+1 : len(t)-1]
+		if tr.op == "add" {
+			tr.args = strings.SplitN(inner, ",", 2) // value can have commas
+		} else {
+			tr.args = strings.Split(inner, ",")
+		}
+		for i := range tr.args {
+			tr.args[i] = strings.TrimSpace(tr.args[i])
+		}
+		if (n != -1 && len(tr.args) != n) || tr.args[0] == "" {
+			return nil, errors.New("invalid arguments for " + t)
+		}
+		for _, f := range tr.targets() {
+			if f == "@timestamp" || f == "@message" || f == "@k8s" {
+				return nil, errors.New(f + " cannot be modified in " + t)
+			}
+		}
+		list = append(list, tr)
+	}
+	return list, nil
+}
+
+// targets returns fields modified by t
+func (t transform) targets() []string {
+	switch t.op {
+	case "add", "nest":
+		return t.args[:1]
+	case "copy":
+		return t.args[1:]
+	}
+	return t.args
+}
+
+func applyTransforms(list []transform, rec map[string]interface{}) {
+	for _, t := range list {
+		switch t.op {
+		case "add":
+			rec[t.args[0]] = t.args[1]
+		case "remove":
+			for _, f := range t.args {
+				delete(rec, f)
+			}
+		case "rename":
+			if v, ok := rec[t.args[0]]; ok {
+				delete(rec, t.args[0])
+				rec[t.args[1]] = v
+			}
+		case "copy":
+			if v, ok := lookupField(rec, t.args[0]); ok {
+				rec[t.args[1]] = v
+			}
+		case "lowercase":
+			for _, f := range t.args {
+				if s, ok := rec[f].(string); ok {
+					rec[f] = strings.ToLower(s)
+				}
+			}
+		case "nest":
+			m := make(map[string]interface{})
+			for k, v := range rec {
+				if !strings.HasPrefix(k, "@") {
+					m[k] = v
+					delete(rec, k)
+				}
+			}
+			if len(m) > 0 {
+				rec[t.args[0]] = m
+			}
+		}
+	}
+}
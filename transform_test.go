@@ -0,0 +1,107 @@
+// Copyright 2019 Santhosh Kumar Tekuri
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransforms(t *testing.T) {
+	list, err := parseTransforms("remove(noisy, debug); rename(msg2,detail); add(env, prod,eu); copy(@level,severity_name); lowercase(method); nest(app)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := map[string]interface{}{
+		"@message":   "hello",
+		"@timestamp": "2020-01-02T10:00:00Z",
+		"@level":     "info",
+		"noisy":      "x",
+		"debug":      "y",
+		"msg2":       "more",
+		"method":     "GET",
+	}
+	applyTransforms(list, rec)
+	want := map[string]interface{}{
+		"@message":   "hello",
+		"@timestamp": "2020-01-02T10:00:00Z",
+		"@level":     "info",
+		"app": map[string]interface{}{
+			"detail":        "more",
+			"env":           "prod,eu",
+			"severity_name": "info",
+			"method":        "get",
+		},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %s", marshal(rec))
+	}
+}
+
+func TestParseTransformsError(t *testing.T) {
+	tests := []string{
+		"remove",
+		"drop(x)",
+		"rename(x)",
+		"add(,x)",
+		"remove(@timestamp)",
+		"rename(@k8s,k8s)",
+		"lowercase(@timestamp)",
+		"remove(@message)",
+		"rename(@message,msg)",
+		"copy(n,@message)",
+	}
+	for _, s := range tests {
+		if _, err := parseTransforms(s); err == nil {
+			t.Fatalf("%q: error expected", s)
+		}
+	}
+	if _, err := parseTransforms("copy(@timestamp,ts)"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTransformConf(t *testing.T) {
+	list, err := parseTransformConf(map[string]string{
+		"transform.b": "remove(noisy)",
+		"transform.a": "add(env,prod); add(region,eu)",
+		"rule.a":      "has(x) => drop",
+	}, "transform.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, tr := range list {
+		ops = append(ops, tr.op+"("+strings.Join(tr.args, ",")+")")
+	}
+	if got := strings.Join(ops, ";"); got != "add(env,prod);add(region,eu);remove(noisy)" {
+		t.Fatal("transforms must be in name order, got", got)
+	}
+
+	for _, m := range []map[string]string{
+		{"transform": "add(env,prod)"},
+		{"transform.": "add(env,prod)"},
+		{"transform.a": "add(env)"},
+	} {
+		if _, err := parseTransformConf(m, "transform."); err == nil {
+			t.Errorf("%v: error expected", m)
+		}
+	}
+	_, err = parseTransformConf(map[string]string{"transform": "add(env,prod)"}, "transform.")
+	if err == nil || !strings.Contains(err.Error(), "transform.NAME") {
+		t.Fatal("error must mention expected key, got", err)
+	}
+}
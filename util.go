@@ -17,6 +17,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -142,6 +143,33 @@ func backOff(round int, max time.Duration) time.Duration {
 	return wait
 }
 
+// retry calls fn until it succeeds, waiting with backOff between
+// attempts. it returns true if cancelled by exit signal
+func retry(name string, fn func() error) (cancelled bool) {
+	round := 0
+	for {
+		err := fn()
+		if err == nil {
+			if round > 0 {
+				info(name, "is reachable")
+			}
+			return false
+		}
+		if err == context.Canceled {
+			return true
+		}
+		if round == 0 {
+			warn(err)
+		}
+		round++
+		select {
+		case <-exitCh:
+			return true
+		case <-time.After(backOff(round, 5*time.Second)):
+		}
+	}
+}
+
 func mkdirs(dir string) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		panic(err)